@@ -0,0 +1,284 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type statusResponse struct {
+	Hosts              int            `json:"hosts"`
+	Groups             int            `json:"groups"`
+	Users              int            `json:"users"`
+	SkippedKeyFiles    int            `json:"skipped_key_files"`
+	SkippedFilesByUser map[string]int `json:"skipped_key_files_by_user"`
+}
+
+type userResponse struct {
+	Username            string `json:"username"`
+	Keys                int    `json:"keys"`
+	Certificates        int    `json:"certificates"`
+	ExpiredKeys         int    `json:"expired_keys"`
+	OldestKeyAgeSeconds int64  `json:"oldest_key_age_seconds"`
+	TimesServed         uint64 `json:"times_served"`
+}
+
+type debugConfigResponse struct {
+	LoadedAt time.Time `yaml:"loaded_at"`
+	Config   Config    `yaml:"config"`
+}
+
+type hostResponse struct {
+	Hostname   string     `json:"hostname"`
+	Entry      string     `json:"entry,omitempty"` // config entry of hosts served by the default entry
+	Users      []string   `json:"users"`
+	Groups     []string   `json:"groups"`
+	LastServed *time.Time `json:"last_served"`
+}
+
+// registerAdminHandlers adds the admin endpoints to mux.
+func (s *Server) registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/status", s.cors(s.requireAdmin(s.statusHandler)))
+	mux.HandleFunc("/users", s.cors(s.requireAdmin(s.usersHandler)))
+	mux.HandleFunc("/hosts", s.cors(s.requireAdmin(s.hostsHandler)))
+	mux.HandleFunc("/export", s.cors(s.requireAdmin(s.exportHandler)))
+	mux.HandleFunc("/debug/config", s.cors(s.requireAdmin(s.debugConfigHandler)))
+	mux.HandleFunc("/maintenance", s.cors(s.requireAdmin(s.maintenanceHandler)))
+	mux.HandleFunc("/reload", s.cors(s.requireAdmin(s.reloadHandler)))
+}
+
+// cors allows browser based dashboards on the configured origins to call an
+// admin endpoint, and answers their preflight requests.
+func (s *Server) cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && (slices.Contains(s.opts.CORSOrigins, "*") || slices.Contains(s.opts.CORSOrigins, origin))
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions {
+			if !allowed {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireAdmin wraps an admin handler so that it is only reachable with the
+// admin token.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := authToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if s.opts.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.AdminToken)) != 1 {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.configLock.RLock()
+	status := statusResponse{
+		Hosts:  len(s.config.Hosts),
+		Groups: len(s.config.Groups),
+	}
+	s.configLock.RUnlock()
+
+	status.Users = s.userKeys.UserCount()
+	status.SkippedFilesByUser, status.SkippedKeyFiles = s.userKeys.SkippedFiles()
+
+	writeJSON(w, status)
+}
+
+func (s *Server) usersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.configLock.RLock()
+	maxKeyAge := s.config.MaxKeyAge
+	s.configLock.RUnlock()
+
+	s.timesServedLock.Lock()
+	timesServed := maps.Clone(s.timesServed)
+	s.timesServedLock.Unlock()
+
+	keyring := s.userKeys.AllKeys()
+	users := make([]userResponse, 0, len(keyring))
+	for username, keys := range keyring {
+		user := userResponse{Username: username, Keys: len(keys), TimesServed: timesServed[username]}
+		for _, key := range keys {
+			if key.Certificate {
+				user.Certificates++
+			}
+			age := time.Since(key.ModTime)
+			if maxKeyAge > 0 && age > maxKeyAge {
+				user.ExpiredKeys++
+			}
+			if seconds := int64(age.Seconds()); seconds > user.OldestKeyAgeSeconds {
+				user.OldestKeyAgeSeconds = seconds
+			}
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	writeJSON(w, users)
+}
+
+// hostsHandler lists all hosts with their users and when they last fetched
+// their keys, to spot hosts that stopped polling.
+func (s *Server) hostsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.lastServedLock.Lock()
+	lastServed := make(map[string]time.Time, len(s.lastServed))
+	for hostname, t := range s.lastServed {
+		lastServed[hostname] = t
+	}
+	s.lastServedLock.Unlock()
+
+	s.configLock.RLock()
+	hosts := make([]hostResponse, 0, len(s.config.Hosts))
+	addHost := func(hostname, entry string, hostConfig HostConfig) {
+		host := hostResponse{
+			Hostname: hostname,
+			Entry:    entry,
+			Users:    []string{},
+			Groups:   hostConfig.Groups,
+		}
+		for user := range s.hostUsers(hostConfig) {
+			host.Users = append(host.Users, user)
+		}
+		sort.Strings(host.Users)
+		if t, ok := lastServed[hostname]; ok {
+			host.LastServed = &t
+		}
+		hosts = append(hosts, host)
+	}
+	for hostname, hostConfig := range s.config.Hosts {
+		addHost(hostname, "", hostConfig)
+	}
+	// Hosts that aren't in the config were served by the default entry
+	if defaultConfig, ok := s.config.Hosts[defaultHost]; ok {
+		for hostname := range lastServed {
+			if _, ok := s.config.Hosts[hostname]; !ok {
+				addHost(hostname, defaultHost, defaultConfig)
+			}
+		}
+	}
+	s.configLock.RUnlock()
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Hostname < hosts[j].Hostname
+	})
+
+	writeJSON(w, hosts)
+}
+
+// debugConfigHandler shows the config currently in memory, with tokens
+// redacted, and when it was loaded.
+func (s *Server) debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.configLock.RLock()
+	resp := debugConfigResponse{
+		LoadedAt: s.configLoaded,
+		Config:   s.config,
+	}
+	s.configLock.RUnlock()
+
+	hosts := make(map[string]HostConfig, len(resp.Config.Hosts))
+	for name, host := range resp.Config.Hosts {
+		if host.Token != "" {
+			host.Token = "REDACTED"
+		}
+		if host.PreviousToken != "" {
+			host.PreviousToken = "REDACTED"
+		}
+		hosts[name] = host
+	}
+	resp.Config.Hosts = hosts
+	if resp.Config.DefaultToken != "" {
+		resp.Config.DefaultToken = "REDACTED"
+	}
+
+	groups := make(map[string]GroupConfig, len(resp.Config.Groups))
+	for name, group := range resp.Config.Groups {
+		if group.LDAP != nil && group.LDAP.BindPassword != "" {
+			ldapSource := *group.LDAP
+			ldapSource.BindPassword = "REDACTED"
+			group.LDAP = &ldapSource
+		}
+		groups[name] = group
+	}
+	resp.Config.Groups = groups
+
+	data, err := yaml.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,438 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configIsFile reports whether the config is read from a file, rather than
+// from stdin ("-") or an http(s) URL.
+func (s *Server) configIsFile() bool {
+	return s.configPath != "-" && !strings.HasPrefix(s.configPath, "http://") && !strings.HasPrefix(s.configPath, "https://")
+}
+
+// readConfig reads the raw main config from its file, stdin or URL.
+func (s *Server) readConfig() ([]byte, error) {
+	switch {
+	case s.configPath == "-":
+		return io.ReadAll(os.Stdin)
+	case !s.configIsFile():
+		resp, err := s.fetchClient.Get(s.configPath)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", s.configPath, resp.Status)
+		}
+		return io.ReadAll(resp.Body)
+	default:
+		return fs.ReadFile(s.files(), s.configPath)
+	}
+}
+
+// files returns where the config is read from: the embedded files if set,
+// the file system otherwise.
+func (s *Server) files() fs.FS {
+	if s.opts.Files != nil {
+		return s.opts.Files
+	}
+	return osFS{}
+}
+
+// applyOverlay deep-merges the overlay file into the config, including
+// what it got from included files. Mappings are merged key by key,
+// anything else in the overlay, including lists, replaces the value of the
+// base config.
+func (s *Server) applyOverlay(config Config) (Config, error) {
+	overlayData, err := os.ReadFile(s.opts.ConfigOverlay)
+	if err != nil {
+		return config, fmt.Errorf("error reading config overlay: %v", err)
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return config, err
+	}
+
+	var base, overlay interface{}
+	if err := yaml.Unmarshal(data, &base); err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(overlayData, &overlay); err != nil {
+		return config, fmt.Errorf("error parsing config overlay: %v", err)
+	}
+	if data, err = yaml.Marshal(mergeYAML(base, overlay)); err != nil {
+		return config, err
+	}
+
+	var merged Config
+	if err := yaml.UnmarshalStrict(data, &merged); err != nil {
+		return config, fmt.Errorf("error applying config overlay: %v", err)
+	}
+	return merged, nil
+}
+
+// mergeYAML merges overlay into base, recursing into mappings.
+func mergeYAML(base, overlay interface{}) interface{} {
+	baseMap, baseIsMap := base.(map[interface{}]interface{})
+	overlayMap, overlayIsMap := overlay.(map[interface{}]interface{})
+	if !baseIsMap || !overlayIsMap {
+		if overlay == nil {
+			return base
+		}
+		return overlay
+	}
+
+	for key, value := range overlayMap {
+		baseMap[key] = mergeYAML(baseMap[key], value)
+	}
+	return baseMap
+}
+
+// validateConfig sanity checks a freshly loaded config.
+func (s *Server) validateConfig(config Config) error {
+	switch config.KeyOrder {
+	case "", keyOrderType, keyOrderFile:
+	default:
+		return fmt.Errorf("invalid config: unknown key_order %q", config.KeyOrder)
+	}
+
+	// Embedded files have no modification time, so every key would be too old
+	if config.MaxKeyAge > 0 && s.opts.Files != nil {
+		return fmt.Errorf("invalid config: max_key_age can't be used with an embedded keyring")
+	}
+	// Keys from a database all share the database file's modification time
+	if config.MaxKeyAge > 0 && s.opts.Keyring.Database != "" {
+		return fmt.Errorf("invalid config: max_key_age can't be used with KEYSERVER_KEYRING_DB")
+	}
+
+	if tokenHashed(config.DefaultToken) {
+		if err := validateTokenHash(config.DefaultToken); err != nil {
+			return fmt.Errorf("invalid config: default_token: %v", err)
+		}
+	}
+
+	for name, host := range config.Hosts {
+		for _, token := range []string{host.Token, host.PreviousToken} {
+			if tokenHashed(token) {
+				if err := validateTokenHash(token); err != nil {
+					return fmt.Errorf("invalid token hash for host %s: %v", name, err)
+				}
+			}
+		}
+		if host.Restrictions != nil {
+			if err := host.Restrictions.validate(); err != nil {
+				return fmt.Errorf("invalid restrictions for host %s: %v", name, err)
+			}
+		}
+		if host.PreviousToken != "" {
+			if host.PreviousTokenExpires.IsZero() {
+				return fmt.Errorf("invalid config: previous_token of host %s needs previous_token_expires", name)
+			}
+			if time.Now().After(host.PreviousTokenExpires) {
+				logWarnf("Previous token of host %s expired at %s and can be removed", name, host.PreviousTokenExpires.Format(time.RFC3339))
+			}
+		}
+		for i, rule := range host.CommentRules {
+			if rule.Pattern == nil {
+				return fmt.Errorf("invalid config: comment rule %d of host %s has no pattern", i+1, name)
+			}
+		}
+		switch host.LineEnding {
+		case "", lineEndingLF, lineEndingCRLF:
+		default:
+			return fmt.Errorf("invalid config: unknown line_ending %q for host %s", host.LineEnding, name)
+		}
+		if subdir := host.KeyringSubdir; subdir != "" && (!filepath.IsLocal(subdir) || filepath.Clean(subdir) != subdir) {
+			return fmt.Errorf("invalid keyring_subdir %q for host %s", subdir, name)
+		}
+	}
+
+	for _, cycle := range groupCycles(config) {
+		logWarnf("Groups reference each other in a cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	var problems []string
+	if s.opts.MaxHosts > 0 && len(config.Hosts) > s.opts.MaxHosts {
+		problems = append(problems, fmt.Sprintf("%d hosts exceed the limit of %d", len(config.Hosts), s.opts.MaxHosts))
+	}
+	if s.opts.MaxGroups > 0 && len(config.Groups) > s.opts.MaxGroups {
+		problems = append(problems, fmt.Sprintf("%d groups exceed the limit of %d", len(config.Groups), s.opts.MaxGroups))
+	}
+
+	for _, problem := range problems {
+		if s.opts.EnforceLimits {
+			return fmt.Errorf("invalid config: %s", problem)
+		}
+		logWarnf("Suspicious config: %s", problem)
+	}
+	return nil
+}
+
+// keyringSubdirs returns the keyring subdirectories used by the hosts of
+// config, sorted.
+func keyringSubdirs(config Config) []string {
+	var subdirs []string
+	for _, host := range config.Hosts {
+		if host.KeyringSubdir != "" && !slices.Contains(subdirs, host.KeyringSubdir) {
+			subdirs = append(subdirs, host.KeyringSubdir)
+		}
+	}
+	sort.Strings(subdirs)
+	return subdirs
+}
+
+// lowercaseUsers converts all usernames in config to lower case.
+func lowercaseUsers(config *Config) {
+	for name, host := range config.Hosts {
+		host.Users = lowercaseAll(host.Users)
+		config.Hosts[name] = host
+	}
+	for name, group := range config.Groups {
+		group.Users = lowercaseAll(group.Users)
+		config.Groups[name] = group
+	}
+	config.AllowedUsers = lowercaseAll(config.AllowedUsers)
+}
+
+// lowercaseAll returns a copy of names in lower case.
+func lowercaseAll(names []string) []string {
+	if names == nil {
+		return nil
+	}
+	lower := make([]string, len(names))
+	for i, name := range names {
+		lower[i] = strings.ToLower(name)
+	}
+	return lower
+}
+
+// groupCycles finds groups that contain themselves through their groups.
+// Each cycle is returned as the path of group names leading back to its
+// first group. Resolving group members stops at groups it has already seen,
+// so cycles are harmless, but they usually are a mistake.
+func groupCycles(config Config) [][]string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+	var cycles [][]string
+
+	var visit func(name string)
+	visit = func(name string) {
+		switch state[name] {
+		case inProgress:
+			start := slices.Index(path, name)
+			cycles = append(cycles, append(slices.Clone(path[start:]), name))
+			return
+		case done:
+			return
+		}
+
+		state[name] = inProgress
+		path = append(path, name)
+		for _, member := range config.Groups[name].Groups {
+			visit(member)
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+	}
+
+	names := make([]string, 0, len(config.Groups))
+	for name := range config.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		visit(name)
+	}
+	return cycles
+}
+
+// configDir is the directory relative include patterns are resolved in: the
+// directory of the main config file, or the working directory if the config
+// doesn't come from a file.
+func (s *Server) configDir() string {
+	if !s.configIsFile() {
+		return "."
+	}
+	return filepath.Dir(s.configPath)
+}
+
+// includePatterns returns the include globs of the current config, relative
+// to configDir.
+func (s *Server) includePatterns(config Config) []string {
+	patterns := make([]string, 0, len(config.Include))
+	for _, pattern := range config.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(s.configDir(), pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// mergeIncludes adds the hosts and groups of all files matched by the include
+// globs to config. Hosts or groups defined in more than one file are
+// rejected, since it's unclear which definition should win.
+func (s *Server) mergeIncludes(config *Config) error {
+	if config.Hosts == nil {
+		config.Hosts = make(map[string]HostConfig)
+	}
+	if config.Groups == nil {
+		config.Groups = make(map[string]GroupConfig)
+	}
+
+	hostSources := make(map[string]string)
+	for name := range config.Hosts {
+		hostSources[name] = s.configPath
+	}
+	groupSources := make(map[string]string)
+	for name := range config.Groups {
+		groupSources[name] = s.configPath
+	}
+
+	for _, pattern := range s.includePatterns(*config) {
+		files, err := fs.Glob(s.files(), pattern)
+		if err != nil {
+			return fmt.Errorf("invalid include pattern %q: %v", pattern, err)
+		}
+
+		for _, file := range files {
+			data, err := fs.ReadFile(s.files(), file)
+			if err != nil {
+				return fmt.Errorf("error reading included config file: %v", err)
+			}
+
+			var included Config
+			if err := yaml.UnmarshalStrict(data, &included); err != nil {
+				return fmt.Errorf("error parsing included config file %s: %v", file, err)
+			}
+			if len(included.Include) > 0 {
+				logWarnf("Ignoring nested includes in %s", file)
+			}
+
+			for name, host := range included.Hosts {
+				if source, exists := hostSources[name]; exists {
+					return fmt.Errorf("host %s in %s is already defined in %s", name, file, source)
+				}
+				hostSources[name] = file
+				config.Hosts[name] = host
+			}
+			for name, group := range included.Groups {
+				if source, exists := groupSources[name]; exists {
+					return fmt.Errorf("group %s in %s is already defined in %s", name, file, source)
+				}
+				groupSources[name] = file
+				config.Groups[name] = group
+			}
+		}
+	}
+
+	return nil
+}
+
+// watchIncludes watches the directories of the include globs, so that added,
+// changed and removed files trigger a reload.
+func (s *Server) watchIncludes() {
+	if s.configWatcher == nil {
+		return
+	}
+
+	s.configLock.RLock()
+	patterns := s.includePatterns(s.config)
+	s.configLock.RUnlock()
+
+	for _, pattern := range patterns {
+		dir := filepath.Dir(pattern)
+		if err := s.configWatcher.Add(dir); err != nil {
+			logErrorf("Error watching included config directory %s: %v", dir, err)
+		}
+	}
+}
+
+// isIncluded reports whether a file is matched by one of the include globs.
+func (s *Server) isIncluded(name string) bool {
+	s.configLock.RLock()
+	patterns := s.includePatterns(s.config)
+	s.configLock.RUnlock()
+
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Pattern is a regular expression in the config. It is compiled when the
+// config is loaded, so that an invalid expression rejects the config.
+type Pattern struct {
+	*regexp.Regexp
+}
+
+func (p *Pattern) UnmarshalYAML(unmarshal func(any) error) error {
+	var expr string
+	if err := unmarshal(&expr); err != nil {
+		return err
+	}
+	return p.compile(expr)
+}
+
+func (p Pattern) MarshalYAML() (any, error) {
+	return p.String(), nil
+}
+
+func (p *Pattern) UnmarshalJSON(data []byte) error {
+	var expr string
+	if err := json.Unmarshal(data, &expr); err != nil {
+		return err
+	}
+	return p.compile(expr)
+}
+
+func (p Pattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *Pattern) compile(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", expr, err)
+	}
+	p.Regexp = re
+	return nil
+}
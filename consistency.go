@@ -0,0 +1,81 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// keyringState summarizes the files of the keyring and the keys file by
+// their paths, sizes and modification times, which is enough to tell
+// whether anything changed without reading the keys.
+func (uk *UserKeys) keyringState() ([sha256.Size]byte, error) {
+	hash := sha256.New()
+	err := fs.WalkDir(uk.opts.Files, uk.keyringPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != uk.keyringPath && uk.ignored(entry.Name()) && entry.IsDir() {
+			return fs.SkipDir
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	if uk.opts.KeysFile != "" {
+		info, err := fs.Stat(uk.opts.Files, filepath.Clean(uk.opts.KeysFile))
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\n", uk.opts.KeysFile, info.Size(), info.ModTime().UnixNano())
+	}
+	return [sha256.Size]byte(hash.Sum(nil)), nil
+}
+
+// checkConsistency periodically compares the keyring files with their state
+// at the last load and reloads if they differ, in case the watcher missed
+// a change, as inotify can under heavy churn or on network filesystems.
+func (uk *UserKeys) checkConsistency() {
+	for range time.Tick(uk.opts.CheckInterval) {
+		state, err := uk.keyringState()
+		if err != nil {
+			logWarnf("Error checking the keyring for missed changes: %v", err)
+			continue
+		}
+		uk.scanLock.Lock()
+		consistent := state == uk.loadedState
+		uk.scanLock.Unlock()
+		if consistent {
+			continue
+		}
+		logWarnf("Keyring changed without the watcher noticing, reloading")
+		keyringInconsistencies.inc(uk.opts.Name)
+		uk.changed()
+	}
+}
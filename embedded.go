@@ -0,0 +1,40 @@
+//go:build embed
+
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The embedded directory holds config.yaml and the keyring when building a
+// self-contained binary with the embed tag.
+//
+//go:embed all:embedded
+var embedded embed.FS
+
+func init() {
+	files, err := fs.Sub(embedded, "embedded")
+	if err != nil {
+		panic(err)
+	}
+	embeddedFiles = files
+}
@@ -0,0 +1,56 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Defaults for fetching from the network while loading, see Options.
+const (
+	defaultFetchConnectTimeout = 5 * time.Second
+	defaultFetchTimeout        = 10 * time.Second
+)
+
+// fetchTimeouts returns the connect and overall timeouts for network
+// fetches while loading: the config URL, LDAP groups and the upstream of a
+// replica.
+func (s *Server) fetchTimeouts() (connect, overall time.Duration) {
+	connect, overall = s.opts.FetchConnectTimeout, s.opts.FetchTimeout
+	if connect <= 0 {
+		connect = defaultFetchConnectTimeout
+	}
+	if overall <= 0 {
+		overall = defaultFetchTimeout
+	}
+	return connect, overall
+}
+
+// newFetchClient returns an HTTP client that gives up on hung servers after
+// the fetch timeouts, so that they can't block reloads. NewServer creates it
+// once, so that repeated fetches reuse connections.
+func (s *Server) newFetchClient() *http.Client {
+	connect, overall := s.fetchTimeouts()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: connect}).DialContext
+	transport.TLSHandshakeTimeout = connect
+	return &http.Client{Timeout: overall, Transport: transport}
+}
@@ -0,0 +1,68 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fingerprintsHandler serves the SHA256 fingerprints of the keys a host
+// would get from /keys, one per line, so that the key set can be audited
+// without handing out the keys themselves.
+func (s *Server) fingerprintsHandler(w http.ResponseWriter, r *http.Request) {
+	_, hostname, username, hostConfig, ok := s.authorizeHost(w, r, "/fingerprints/")
+	if !ok {
+		return
+	}
+
+	var users []string
+	if !hostConfig.Lockdown {
+		users = s.getUsersForHost(hostname)
+	}
+	if username != "" {
+		if !s.isUserAuthorized(hostname, username) {
+			http.Error(w, "User not authorized for host", http.StatusForbidden)
+			return
+		}
+		if slices.Contains(users, username) {
+			users = []string{username}
+		} else {
+			users = nil
+		}
+	}
+
+	// Audits don't count as serving the keys
+	w.Header().Set("Content-Type", "text/plain")
+	for _, line := range strings.Split(s.collectKeys(hostname, users).keys, "\n") {
+		if line == "" {
+			continue
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			logWarnf("Error parsing served key of %s: %v", hostname, err)
+			continue
+		}
+		fmt.Fprintln(w, ssh.FingerprintSHA256(pub))
+	}
+}
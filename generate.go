@@ -0,0 +1,69 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// generateConfig writes a skeleton config to w with a single host that all
+// users found in the keyring have access to. The Ignore and
+// NormalizeUsername options of opts apply as when loading the keyring.
+func generateConfig(keyringPath string, opts KeyringOptions, w io.Writer) error {
+	if opts.Files == nil {
+		opts.Files = osFS{}
+	}
+	uk := &UserKeys{keyringPath: keyringPath, opts: opts}
+	entries, err := fs.ReadDir(opts.Files, keyringPath)
+	if err != nil {
+		return err
+	}
+
+	users := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || uk.ignored(entry.Name()) {
+			continue
+		}
+		if username := uk.normalizeUsername(entry.Name()); !slices.Contains(users, username) {
+			users = append(users, username)
+		}
+	}
+	sort.Strings(users)
+
+	config := Config{
+		Hosts: map[string]HostConfig{
+			"example-host": {Users: users},
+		},
+		Groups: map[string]GroupConfig{},
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# Generated from %s, set a token for each host before use\n", keyringPath)
+	_, err = w.Write(data)
+	return err
+}
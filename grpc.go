@@ -0,0 +1,122 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/elsitar/ssh-keyserver --go-grpc_out=. --go-grpc_opt=module=github.com/elsitar/ssh-keyserver keyserver.proto
+
+import (
+	"context"
+	"strings"
+
+	"github.com/elsitar/ssh-keyserver/keyserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newGRPCServer returns a gRPC server exposing the keyserver.v1.KeyServer
+// service of s.
+func newGRPCServer(s *Server, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(s.shedGRPCLoad))
+	g := grpc.NewServer(opts...)
+	keyserverpb.RegisterKeyServerServer(g, grpcKeyServer{s: s})
+	return g
+}
+
+// grpcKeyServer implements keyserverpb.KeyServerServer on top of the HTTP
+// server's host and key lookups.
+type grpcKeyServer struct {
+	keyserverpb.UnimplementedKeyServerServer
+	s *Server
+}
+
+func (g grpcKeyServer) GetKeys(ctx context.Context, req *keyserverpb.GetKeysRequest) (*keyserverpb.GetKeysResponse, error) {
+	s := g.s
+	if s.warmingUp() {
+		return nil, status.Error(codes.Unavailable, "Warming up")
+	}
+	if s.keyringStale() {
+		return nil, status.Error(codes.Unavailable, "Keyring is stale")
+	}
+	if s.maintenanceMode() != nil {
+		return nil, status.Error(codes.Unavailable, "Down for maintenance")
+	}
+
+	if req.Hostname == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing hostname")
+	}
+	if !validHostname(req.Hostname) {
+		return nil, status.Error(codes.InvalidArgument, "Invalid hostname")
+	}
+	username := req.Username
+	if username != "" && !validHostname(username) {
+		return nil, status.Error(codes.InvalidArgument, "Invalid username")
+	}
+	if s.opts.LowercaseUsernames {
+		username = strings.ToLower(username)
+	}
+	hostname := req.Hostname
+	entry, hostConfig, exists := s.resolveHost(hostname)
+	if !exists {
+		return nil, status.Error(codes.NotFound, "Host not found")
+	}
+	if !s.validateTokens(entry, req.Token) {
+		return nil, status.Error(codes.Unauthenticated, "Invalid token")
+	}
+
+	if _, ok := s.allowRequest(hostname, hostConfig); !ok {
+		return nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+	}
+
+	if hostConfig.Lockdown {
+		logDebugf("Serving no keys for %s over gRPC, host is in lockdown", hostname)
+		s.markServed(hostname)
+		return &keyserverpb.GetKeysResponse{}, nil
+	}
+
+	result := s.resolveKeys(entry, username, req.Group)
+	switch {
+	case result.forbidden != "":
+		return nil, status.Error(codes.PermissionDenied, result.forbidden)
+	case result.noKeys != "":
+		return s.grpcNoKeys(hostname, result.noKeys)
+	}
+
+	var keys []string
+	for _, line := range strings.Split(result.keys, "\n") {
+		if line = strings.TrimSuffix(line, "\r"); line != "" {
+			keys = append(keys, line)
+		}
+	}
+
+	s.countKeySet(result.keySet)
+	logDebugf("Serving %d keys for %s and users %s over gRPC", len(keys), hostname, result.users)
+	s.markServed(hostname)
+	return &keyserverpb.GetKeysResponse{Keys: keys}, nil
+}
+
+// grpcNoKeys is noKeys for gRPC: an empty response if empty answers are
+// allowed, NotFound otherwise.
+func (s *Server) grpcNoKeys(hostname, msg string) (*keyserverpb.GetKeysResponse, error) {
+	if s.opts.AllowEmpty {
+		s.markServed(hostname)
+		return &keyserverpb.GetKeysResponse{}, nil
+	}
+	return nil, status.Error(codes.NotFound, msg)
+}
@@ -0,0 +1,88 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// livezHandler reports that the process is alive and serving requests.
+func (s *Server) livezHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports whether the server is ready to serve keys, i.e. both
+// the config and the keyring were loaded and aren't empty, and the keyring
+// has at least MinUsers users.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if reason := s.notReadyReason(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// notReadyReason explains why the server isn't ready, or returns an empty
+// string if it is.
+func (s *Server) notReadyReason() string {
+	s.configLock.RLock()
+	configLoaded := !s.configLoaded.IsZero()
+	hosts := len(s.config.Hosts)
+	s.configLock.RUnlock()
+
+	switch {
+	case !configLoaded:
+		return "Config not loaded"
+	case hosts == 0:
+		return "Config has no hosts"
+	case s.userKeys == nil || s.userKeys.LoadedAt().IsZero():
+		return "Keyring not loaded"
+	case s.userKeys.UserCount() == 0:
+		return "Keyring has no users"
+	case s.keyringStale():
+		return "Keyring is stale"
+	case s.warmingUp():
+		return "Warming up"
+	case !s.enoughUsers():
+		return "Keyring has too few users"
+	}
+	return ""
+}
+
+// enoughUsers reports whether the keyring has at least MinUsers users,
+// logging when that changes.
+func (s *Server) enoughUsers() bool {
+	count := s.userKeys.UserCount()
+	tooFew := count < s.opts.MinUsers
+
+	s.tooFewUsersLock.Lock()
+	defer s.tooFewUsersLock.Unlock()
+	if tooFew != s.tooFewUsers {
+		if tooFew {
+			logWarnf("Not ready, the keyring has %d users but at least %d are expected", count, s.opts.MinUsers)
+		} else {
+			logInfof("The keyring has %d users, reaching the expected minimum of %d", count, s.opts.MinUsers)
+		}
+		s.tooFewUsers = tooFew
+	}
+	return !tooFew
+}
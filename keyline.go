@@ -0,0 +1,156 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKeyLine formats a key as an authorized_keys line.
+func authorizedKeyLine(options []string, pub ssh.PublicKey, comment string) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if len(options) > 0 {
+		line = strings.Join(options, ",") + " " + line
+	}
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+// rewriteComment replaces the comment of an authorized_keys line with
+// <username>@keyserver, so that host logs show whom a key belongs to.
+func rewriteComment(line, username string) string {
+	pub, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return line
+	}
+	return authorizedKeyLine(options, pub, username+"@keyserver")
+}
+
+// CommentRule replaces matches of Pattern in the comments of keys served to
+// a host with Replace, which may refer to capture groups like $1.
+type CommentRule struct {
+	Pattern *Pattern `yaml:"pattern"`
+	Replace string   `yaml:"replace,omitempty"`
+}
+
+// sanitizeComment applies rules in order to the comment of an
+// authorized_keys line, e.g. to strip internal IPs or ticket numbers.
+func sanitizeComment(line string, rules []CommentRule) string {
+	pub, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return line
+	}
+	for _, rule := range rules {
+		comment = rule.Pattern.ReplaceAllString(comment, rule.Replace)
+	}
+	return authorizedKeyLine(options, pub, strings.Join(strings.Fields(comment), " "))
+}
+
+// Restrictions are the options of every key served to a host. Keys get
+// "restrict", which disables all forwarding, PTY allocation and rc files,
+// plus the features listed in Permit.
+type Restrictions struct {
+	// Permit re-enables features, see restrictionFeatures.
+	Permit []string `yaml:"permit,omitempty"`
+	// Command forces a command, regardless of what the client asks for.
+	Command string `yaml:"command,omitempty"`
+	// From limits the source addresses keys may be used from, as patterns
+	// like "10.0.0.0/8" or "*.example.com".
+	From []string `yaml:"from,omitempty"`
+}
+
+// restrictionFeatures are the features that can be re-enabled after
+// "restrict", see AUTHORIZED_KEYS FILE FORMAT in sshd(8).
+var restrictionFeatures = []string{"agent-forwarding", "port-forwarding", "pty", "user-rc", "X11-forwarding"}
+
+// validate checks that the restrictions render to valid options.
+func (r *Restrictions) validate() error {
+	for _, feature := range r.Permit {
+		if !slices.Contains(restrictionFeatures, feature) {
+			return fmt.Errorf("unknown feature %q in permit, expected one of %s", feature, strings.Join(restrictionFeatures, ", "))
+		}
+	}
+	if strings.ContainsAny(r.Command, "\"\\\n") {
+		return fmt.Errorf("command must not contain quotes, backslashes or newlines")
+	}
+	for _, pattern := range r.From {
+		if pattern == "" || strings.ContainsAny(pattern, "\",\\ \t\n") {
+			return fmt.Errorf("invalid from pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// options renders the restrictions as authorized_keys options.
+func (r *Restrictions) options() []string {
+	options := []string{"restrict"}
+	options = append(options, r.Permit...)
+	if r.Command != "" {
+		options = append(options, `command="`+r.Command+`"`)
+	}
+	if len(r.From) > 0 {
+		options = append(options, `from="`+strings.Join(r.From, ",")+`"`)
+	}
+	return options
+}
+
+// limitingOptions are the key options that only narrow down what a key can
+// do. They are kept when restricting a key; all other options grant
+// something and are dropped.
+var limitingOptions = []string{"command", "from", "expiry-time", "principals", "permitopen", "permitlisten", "verify-required"}
+
+// optionName returns the lower-cased name of an authorized_keys option like
+// `command="..."`.
+func optionName(option string) string {
+	name, _, _ := strings.Cut(option, "=")
+	return strings.ToLower(name)
+}
+
+// restrictKey puts the restrictions on top of the options of an
+// authorized_keys line. The key keeps its own limiting options, like a
+// forced command or a from= list, and loses those that grant something. A
+// key whose command or from= differs from the restrictions' can't honor
+// both and is rejected.
+func restrictKey(line string, r *Restrictions) (string, error) {
+	pub, comment, keyOptions, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return line, nil
+	}
+	options := r.options()
+	for _, option := range keyOptions {
+		name := optionName(option)
+		if !slices.Contains(limitingOptions, name) {
+			continue
+		}
+		if i := slices.IndexFunc(options, func(o string) bool { return optionName(o) == name }); i >= 0 {
+			if options[i] != option {
+				return "", fmt.Errorf("its %s option conflicts with the host's restrictions", name)
+			}
+			continue
+		}
+		options = append(options, option)
+	}
+	return authorizedKeyLine(options, pub, comment), nil
+}
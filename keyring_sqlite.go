@@ -0,0 +1,80 @@
+//go:build sqlite
+
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// loadDatabase adds the keys returned by the database query to keyring.
+func (uk *UserKeys) loadDatabase(keyring map[string][]Key, skipped map[string]int) error {
+	path := uk.opts.Database
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(uk.opts.DatabaseQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]map[string]string) // username -> fingerprint -> source
+	for rows.Next() {
+		var username, keyLine string
+		if err := rows.Scan(&username, &keyLine); err != nil {
+			return err
+		}
+		username = uk.normalizeUsername(strings.TrimSpace(username))
+		if username == "" {
+			logWarnf("Skipping key without username in %s", path)
+			continue
+		}
+		if uk.exceedsMaxLineLength(keyLine) {
+			logWarnf("Skipping key of user %s in %s, it is longer than %d bytes", username, path, uk.opts.MaxLineLength)
+			skipped[username]++
+			continue
+		}
+
+		if seen[username] == nil {
+			seen[username] = make(map[string]string)
+		}
+		key, ok, invalid := uk.parseKeyLine(username, keyLine, path, info.ModTime(), seen[username])
+		if invalid {
+			skipped[username]++
+		}
+		if ok {
+			keyring[username] = append(keyring[username], key)
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,123 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: keyserver.proto
+
+package keyserverpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	KeyServer_GetKeys_FullMethodName = "/keyserver.v1.KeyServer/GetKeys"
+)
+
+// KeyServerClient is the client API for KeyServer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type KeyServerClient interface {
+	// GetKeys returns the authorized keys of a host, one key per entry.
+	GetKeys(ctx context.Context, in *GetKeysRequest, opts ...grpc.CallOption) (*GetKeysResponse, error)
+}
+
+type keyServerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKeyServerClient(cc grpc.ClientConnInterface) KeyServerClient {
+	return &keyServerClient{cc}
+}
+
+func (c *keyServerClient) GetKeys(ctx context.Context, in *GetKeysRequest, opts ...grpc.CallOption) (*GetKeysResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetKeysResponse)
+	err := c.cc.Invoke(ctx, KeyServer_GetKeys_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KeyServerServer is the server API for KeyServer service.
+// All implementations must embed UnimplementedKeyServerServer
+// for forward compatibility.
+type KeyServerServer interface {
+	// GetKeys returns the authorized keys of a host, one key per entry.
+	GetKeys(context.Context, *GetKeysRequest) (*GetKeysResponse, error)
+	mustEmbedUnimplementedKeyServerServer()
+}
+
+// UnimplementedKeyServerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedKeyServerServer struct{}
+
+func (UnimplementedKeyServerServer) GetKeys(context.Context, *GetKeysRequest) (*GetKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetKeys not implemented")
+}
+func (UnimplementedKeyServerServer) mustEmbedUnimplementedKeyServerServer() {}
+func (UnimplementedKeyServerServer) testEmbeddedByValue()                   {}
+
+// UnsafeKeyServerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to KeyServerServer will
+// result in compilation errors.
+type UnsafeKeyServerServer interface {
+	mustEmbedUnimplementedKeyServerServer()
+}
+
+func RegisterKeyServerServer(s grpc.ServiceRegistrar, srv KeyServerServer) {
+	// If the following call pancis, it indicates UnimplementedKeyServerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&KeyServer_ServiceDesc, srv)
+}
+
+func _KeyServer_GetKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyServerServer).GetKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: KeyServer_GetKeys_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyServerServer).GetKeys(ctx, req.(*GetKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// KeyServer_ServiceDesc is the grpc.ServiceDesc for KeyServer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var KeyServer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "keyserver.v1.KeyServer",
+	HandlerType: (*KeyServerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetKeys",
+			Handler:    _KeyServer_GetKeys_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "keyserver.proto",
+}
@@ -0,0 +1,91 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// loadHostKeys loads the host keyring, which is laid out like the keyring
+// with a directory of public keys per host instead of per user.
+func (s *Server) loadHostKeys(path string) error {
+	opts := KeyringOptions{
+		Name:          "host_keyring",
+		Ignore:        s.opts.Keyring.Ignore,
+		Files:         s.opts.Keyring.Files,
+		MaxLineLength: s.opts.Keyring.MaxLineLength,
+		QuietPeriod:   s.opts.Keyring.QuietPeriod,
+		CheckInterval: s.opts.Keyring.CheckInterval,
+	}
+	hostKeys, err := NewUserKeys(path, opts)
+	if err != nil {
+		return err
+	}
+	s.hostKeys = hostKeys
+	return nil
+}
+
+// knownHostsHandler serves the keys of all hosts in the host keyring as
+// known_hosts entries, so that hosts can verify each other.
+func (s *Server) knownHostsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.hostKeys == nil {
+		http.NotFound(w, r)
+		return
+	}
+	hostname, _, username, _, ok := s.authorizeHost(w, r, "/known_hosts/")
+	if !ok {
+		return
+	}
+	if username != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	allKeys := s.hostKeys.AllKeys()
+	hosts := make([]string, 0, len(allKeys))
+	for host := range allKeys {
+		if validHostname(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	var count int
+	w.Header().Set("Content-Type", "text/plain")
+	for _, host := range hosts {
+		for _, key := range allKeys[host] {
+			if key.Certificate {
+				continue
+			}
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Line))
+			if err != nil {
+				logWarnf("Error parsing host key of %s: %v", host, err)
+				continue
+			}
+			fmt.Fprintln(w, knownhosts.Line([]string{host}, pub))
+			count++
+		}
+	}
+	logDebugf("Serving %d host keys to %s", count, hostname)
+}
@@ -0,0 +1,105 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapPageSize is the page size used for LDAP searches, so that large groups
+// don't run into server side size limits.
+const ldapPageSize = 500
+
+// LDAPSource resolves the members of a group with an LDAP search.
+type LDAPSource struct {
+	URL          string `yaml:"url"`
+	BindDN       string `yaml:"bind_dn,omitempty"`
+	BindPassword string `yaml:"bind_password,omitempty"`
+	BaseDN       string `yaml:"base_dn"`
+	Filter       string `yaml:"filter"`
+	Attribute    string `yaml:"attribute,omitempty"`
+}
+
+// members searches the directory and returns the usernames of all matching
+// entries. Connecting may take up to connectTimeout, and every request to
+// the directory up to timeout.
+func (src *LDAPSource) members(connectTimeout, timeout time.Duration) ([]string, error) {
+	conn, err := ldap.DialURL(src.URL, ldap.DialWithDialer(&net.Dialer{Timeout: connectTimeout}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+
+	if src.BindDN != "" {
+		if err := conn.Bind(src.BindDN, src.BindPassword); err != nil {
+			return nil, fmt.Errorf("error binding as %s: %v", src.BindDN, err)
+		}
+	}
+
+	attribute := src.Attribute
+	if attribute == "" {
+		attribute = "uid"
+	}
+
+	req := ldap.NewSearchRequest(src.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, src.Filter, []string{attribute}, nil)
+	result, err := conn.SearchWithPaging(req, ldapPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("error searching %s: %v", src.BaseDN, err)
+	}
+
+	var users []string
+	for _, entry := range result.Entries {
+		users = append(users, entry.GetAttributeValues(attribute)...)
+	}
+	return users, nil
+}
+
+// resolveLDAPGroups looks up the members of all groups with an LDAP source.
+// If a lookup fails, the members resolved by the previous load are kept, so
+// that a directory outage doesn't lock users out.
+func (s *Server) resolveLDAPGroups(config Config) map[string][]string {
+	s.configLock.RLock()
+	previous := s.ldapMembers
+	s.configLock.RUnlock()
+
+	connectTimeout, timeout := s.fetchTimeouts()
+	resolved := make(map[string][]string)
+	for name, group := range config.Groups {
+		if group.LDAP == nil {
+			continue
+		}
+
+		users, err := group.LDAP.members(connectTimeout, timeout)
+		if err != nil {
+			logWarnf("Error resolving LDAP members of group %s, keeping previous members: %v", name, err)
+			resolved[name] = previous[name]
+			continue
+		}
+
+		logInfof("Resolved %d LDAP members for group %s", len(users), name)
+		resolved[name] = users
+	}
+	return resolved
+}
@@ -0,0 +1,67 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// minLogLevel is the lowest level that is logged.
+var minLogLevel = levelWarn
+
+// parseLogLevel parses a level name such as "debug" or "warn".
+func parseLogLevel(name string) (logLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	}
+	return levelWarn, fmt.Errorf("unknown log level %q", name)
+}
+
+func logf(level logLevel, format string, v ...any) {
+	if level >= minLogLevel {
+		log.Printf(format, v...)
+	}
+}
+
+// logDebugf logs per-request diagnostics that are too chatty for production.
+func logDebugf(format string, v ...any) { logf(levelDebug, format, v...) }
+
+func logInfof(format string, v ...any) { logf(levelInfo, format, v...) }
+
+func logWarnf(format string, v ...any) { logf(levelWarn, format, v...) }
+
+func logErrorf(format string, v ...any) { logf(levelError, format, v...) }
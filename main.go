@@ -19,12 +19,61 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+// shutdownTimeout is how long in-flight requests get to finish on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	generate := flag.Bool("generate-config", false, "print a skeleton config for the users in the keyring and exit")
+	query := flag.String("query", "", "print the keys of this host and exit")
+	queryToken := flag.String("token", "", "host token for -query")
+	hashTokenFlag := flag.Bool("hash-token", false, "print a hash for the config of the token read from stdin and exit")
+	flag.Parse()
+
+	if *hashTokenFlag {
+		token, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("Failed to read token: %v", err)
+		}
+		hash, err := hashToken(strings.TrimSpace(token))
+		if err != nil {
+			log.Fatalf("Failed to hash token: %v", err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	if name := os.Getenv("KEYSERVER_LOG_LEVEL"); name != "" {
+		level, err := parseLogLevel(name)
+		if err != nil {
+			log.Fatalf("Invalid value for KEYSERVER_LOG_LEVEL: %v", err)
+		}
+		minLogLevel = level
+	}
+
 	configPath := os.Getenv("KEYSERVER_CONFIG_PATH")
 	if configPath == "" {
 		configPath = "config.yaml"
@@ -35,21 +84,459 @@ func main() {
 		keyrinPath = "keyring"
 	}
 
-	server, err := NewServer(configPath, keyrinPath)
+	if embeddedFiles != nil {
+		logInfof("Serving the embedded config and keyring, changes are not reloaded")
+	}
+
+	// Lowercasing has to apply to the keyring and the config alike
+	usernameRules := envList("KEYSERVER_USERNAME_RULES")
+	lowercaseUsernames := envBool("KEYSERVER_LOWERCASE_USERNAMES")
+	if lowercaseUsernames {
+		usernameRules = append(usernameRules, "lowercase")
+	}
+	normalizeUsername, err := usernameNormalizer(os.Getenv("KEYSERVER_USERNAME_PATTERN"), usernameRules)
+	if err != nil {
+		log.Fatalf("Invalid username normalization: %v", err)
+	}
+
+	// Skip directories that aren't users, e.g. of a git checkout
+	keyringIgnore := []string{".*", "lost+found"}
+	if _, ok := os.LookupEnv("KEYSERVER_KEYRING_IGNORE"); ok {
+		keyringIgnore = envList("KEYSERVER_KEYRING_IGNORE")
+	}
+	for _, pattern := range keyringIgnore {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid value for KEYSERVER_KEYRING_IGNORE: %q: %v", pattern, err)
+		}
+	}
+
+	if *generate {
+		keyringOpts := KeyringOptions{Ignore: keyringIgnore, Files: embeddedFiles, NormalizeUsername: normalizeUsername}
+		if err := generateConfig(keyrinPath, keyringOpts, os.Stdout); err != nil {
+			log.Fatalf("Failed to generate config: %v", err)
+		}
+		return
+	}
+
+	// Refuse to start with an incomplete TLS setup, or without TLS at all in
+	// hardened mode, rather than falling back to plaintext
+	tlsCert := os.Getenv("KEYSERVER_TLS_CERT")
+	tlsKey := os.Getenv("KEYSERVER_TLS_KEY")
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatalf("KEYSERVER_TLS_CERT and KEYSERVER_TLS_KEY must be set together")
+	}
+	if envBool("KEYSERVER_REQUIRE_TLS") && tlsCert == "" {
+		log.Fatalf("KEYSERVER_REQUIRE_TLS is set but no TLS certificate is configured")
+	}
+	hostFromSNI := envBool("KEYSERVER_HOST_FROM_SNI")
+	if hostFromSNI && tlsCert == "" {
+		log.Fatalf("KEYSERVER_HOST_FROM_SNI is set but no TLS certificate is configured")
+	}
+
+	contentType := os.Getenv("KEYSERVER_CONTENT_TYPE")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	overloadStatus := envInt("KEYSERVER_OVERLOAD_STATUS", http.StatusServiceUnavailable)
+	if overloadStatus < 400 || overloadStatus > 599 {
+		log.Fatalf("Invalid value for KEYSERVER_OVERLOAD_STATUS: %d is not an error status", overloadStatus)
+	}
+	overloadMessage := os.Getenv("KEYSERVER_OVERLOAD_MESSAGE")
+	if overloadMessage == "" {
+		overloadMessage = "Server overloaded, retry later"
+	}
+
+	dbQuery := os.Getenv("KEYSERVER_KEYRING_DB_QUERY")
+	if dbQuery == "" {
+		dbQuery = "SELECT username, key FROM keys"
+	}
+
+	// Durations have to be positive, but 0 turns the consistency check off
+	var checkInterval time.Duration
+	if os.Getenv("KEYSERVER_KEYRING_CHECK_INTERVAL") != "0" {
+		checkInterval = envDuration("KEYSERVER_KEYRING_CHECK_INTERVAL", 5*time.Minute)
+	}
+
+	var commentIdentity *regexp.Regexp
+	if pattern := os.Getenv("KEYSERVER_COMMENT_IDENTITY"); pattern != "" {
+		commentIdentity, err = regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("Invalid value for KEYSERVER_COMMENT_IDENTITY: %v", err)
+		}
+	}
+
+	opts := Options{
+		AllowEmpty:      envBool("KEYSERVER_ALLOW_EMPTY"),
+		AdminToken:      os.Getenv("KEYSERVER_ADMIN_TOKEN"),
+		AllowQueryToken: envBool("KEYSERVER_ALLOW_QUERY_TOKEN"),
+		DecodeTokens:    envBool("KEYSERVER_DECODE_TOKENS"),
+		HostFromSNI:     hostFromSNI,
+		ConfigOverlay:   os.Getenv("KEYSERVER_CONFIG_OVERLAY"),
+		Files:           embeddedFiles,
+
+		LowercaseUsernames: lowercaseUsernames,
+		ContentType:        contentType,
+		CacheControl:       os.Getenv("KEYSERVER_CACHE_CONTROL"),
+		Filename:           os.Getenv("KEYSERVER_FILENAME"),
+		WebhookURL:         os.Getenv("KEYSERVER_WEBHOOK_URL"),
+		Warmup:             envDuration("KEYSERVER_WARMUP", 0),
+		KeyringMaxAge:      envDuration("KEYSERVER_KEYRING_MAX_AGE", 0),
+		MinUsers:           envInt("KEYSERVER_MIN_USERS", 0),
+		HostKeyringPath:    os.Getenv("KEYSERVER_HOST_KEYRING_PATH"),
+
+		MaxConcurrentRequests: envInt("KEYSERVER_MAX_CONCURRENT_REQUESTS", 0),
+		RateLimit:             envInt("KEYSERVER_RATE_LIMIT", 0),
+		OverloadStatus:        overloadStatus,
+		OverloadMessage:       overloadMessage,
+		OverloadRetryAfter:    envDuration("KEYSERVER_OVERLOAD_RETRY_AFTER", 0),
+
+		CORSOrigins: envList("KEYSERVER_CORS_ORIGINS"),
+
+		Keyring: KeyringOptions{
+			KeysFile:      os.Getenv("KEYSERVER_KEYS_FILE"),
+			Ignore:        keyringIgnore,
+			Files:         embeddedFiles,
+			MaxLineLength: envInt("KEYSERVER_MAX_KEY_LINE_LENGTH", 16384),
+			QuietPeriod:   envDuration("KEYSERVER_KEYRING_QUIET_PERIOD", time.Second),
+			CheckInterval: checkInterval,
+
+			NormalizeUsername: normalizeUsername,
+			CommentIdentity:   commentIdentity,
+
+			Database:         os.Getenv("KEYSERVER_KEYRING_DB"),
+			DatabaseQuery:    dbQuery,
+			DatabaseInterval: envDuration("KEYSERVER_KEYRING_DB_INTERVAL", 30*time.Second),
+		},
+
+		MaxHosts:      envInt("KEYSERVER_MAX_HOSTS", 0),
+		MaxGroups:     envInt("KEYSERVER_MAX_GROUPS", 0),
+		EnforceLimits: envBool("KEYSERVER_ENFORCE_LIMITS"),
+
+		FetchConnectTimeout: envDuration("KEYSERVER_FETCH_CONNECT_TIMEOUT", defaultFetchConnectTimeout),
+		FetchTimeout:        envDuration("KEYSERVER_FETCH_TIMEOUT", defaultFetchTimeout),
+
+		UpstreamURL:      os.Getenv("KEYSERVER_UPSTREAM_URL"),
+		UpstreamToken:    os.Getenv("KEYSERVER_UPSTREAM_TOKEN"),
+		UpstreamInterval: envDuration("KEYSERVER_UPSTREAM_INTERVAL", time.Minute),
+	}
+
+	server, err := NewServer(configPath, keyrinPath, opts)
 	if err != nil {
 		log.Fatalf("Failed to initialize server: %v", err)
 	}
 
+	if *query != "" {
+		if err := server.queryKeys(os.Stdout, *query, *queryToken); err != nil {
+			log.Fatalf("Query for %s failed: %v", *query, err)
+		}
+		return
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/keys/", server.getKeysHandler)
+	mux.HandleFunc("/keys/", server.shedLoad(server.getKeysHandler))
+	mux.HandleFunc("/fingerprints/", server.shedLoad(server.fingerprintsHandler))
+	mux.HandleFunc("/principals/", server.shedLoad(server.principalsHandler))
+	mux.HandleFunc("/known_hosts/", server.shedLoad(server.knownHostsHandler))
+	mux.HandleFunc("/livez", server.livezHandler)
+	mux.HandleFunc("/readyz", server.readyzHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/validate", server.validateHandler)
+
+	var tlsConfig *tls.Config
+	if tlsCert != "" {
+		certs, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	}
+
+	var servers []*http.Server
+	serve := func(srv *http.Server, listener net.Listener) {
+		servers = append(servers, srv)
+		srv.TLSConfig = tlsConfig
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				err = srv.ServeTLS(listener, "", "")
+			} else {
+				err = srv.Serve(listener)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Admin endpoints share the keys port unless they have their own address
+	adminAddr := os.Getenv("KEYSERVER_ADMIN_ADDR")
+	switch {
+	case opts.AdminToken == "":
+		if adminAddr != "" {
+			logWarnf("Ignoring KEYSERVER_ADMIN_ADDR, admin endpoints are disabled without KEYSERVER_ADMIN_TOKEN")
+		}
+	case adminAddr == "":
+		server.registerAdminHandlers(mux)
+	default:
+		adminMux := http.NewServeMux()
+		server.registerAdminHandlers(adminMux)
+		adminListener, err := net.Listen("tcp", adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logInfof("Starting admin server on %s", adminListener.Addr())
+		serve(&http.Server{Handler: recoverPanics(adminMux)}, adminListener)
+	}
+
+	socketPath := os.Getenv("KEYSERVER_UNIX_SOCKET")
+	var listener net.Listener
+	if socketPath != "" {
+		listener, err = listenUnix(socketPath, envFileMode("KEYSERVER_UNIX_SOCKET_MODE", 0660))
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", socketPath, err)
+		}
+		logInfof("Starting server on socket %s", socketPath)
+	} else {
+		addr, err := listenAddr()
+		if err != nil {
+			log.Fatalf("Invalid listen address: %v", err)
+		}
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logInfof("Starting server on %s", listener.Addr())
+	}
+
+	serve(&http.Server{Handler: recoverPanics(mux)}, listener)
+
+	// Send plaintext clients that still use old URLs over to HTTPS
+	if redirectAddr := os.Getenv("KEYSERVER_HTTP_REDIRECT_ADDR"); redirectAddr != "" {
+		tcpAddr, ok := listener.Addr().(*net.TCPAddr)
+		if tlsConfig == nil || !ok {
+			log.Fatalf("KEYSERVER_HTTP_REDIRECT_ADDR needs TLS on a TCP listener")
+		}
+		redirectListener, err := net.Listen("tcp", redirectAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logInfof("Redirecting HTTP on %s to HTTPS", redirectListener.Addr())
+		redirectSrv := &http.Server{Handler: redirectToHTTPS(tcpAddr.Port)}
+		servers = append(servers, redirectSrv)
+		go func() {
+			if err := redirectSrv.Serve(redirectListener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Serve keys over gRPC as well if asked to
+	var grpcServer *grpc.Server
+	if grpcAddr := os.Getenv("KEYSERVER_GRPC_ADDR"); grpcAddr != "" {
+		var grpcOpts []grpc.ServerOption
+		if tlsConfig != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcServer = newGRPCServer(server, grpcOpts...)
+		grpcListener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logInfof("Starting gRPC server on %s", grpcListener.Addr())
+		go func() {
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Tell supervisors that watch for a file that the initial load is done
+	readyFile := os.Getenv("KEYSERVER_READY_FILE")
+	if readyFile != "" {
+		if err := os.WriteFile(readyFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			log.Fatalf("Failed to write ready file: %v", err)
+		}
+	}
+
+	// Shut down gracefully, letting in-flight requests finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	logInfof("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logErrorf("Error shutting down: %v", err)
+		}
+	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	for _, path := range []string{socketPath, readyFile} {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logErrorf("Error removing %s: %v", path, err)
+		}
+	}
+}
+
+// recoverPanics turns a panic in a handler into a 500 response and logs it
+// with its stack trace, instead of just dropping the connection.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logErrorf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS permanently redirects every request to the same URL over
+// HTTPS on port.
+func redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Without a host, such as from HTTP/1.0 clients, there's nowhere
+		// to redirect to
+		host := r.Host
+		if host == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			// A bracketed IPv6 address without a port, e.g. "[::1]"
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// listenAddr returns the TCP address to listen on. KEYSERVER_LISTEN_ADDR takes
+// a full address such as "127.0.0.1:8080", "[::1]:8080" or
+// "keyserver.internal:8080"; otherwise all interfaces are used with
+// KEYSERVER_PORT.
+func listenAddr() (string, error) {
+	if addr := os.Getenv("KEYSERVER_LISTEN_ADDR"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", err
+		}
+		return addr, nil
+	}
 
 	port := os.Getenv("KEYSERVER_PORT")
 	if port == "" {
 		port = "8080"
 	}
+	return net.JoinHostPort("", port), nil
+}
 
-	log.Printf("Starting server on port %s", port)
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
-		log.Fatal(err)
+// listenUnix listens on a Unix domain socket, replacing a stale socket left
+// behind by a previous run.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// envBool reports whether the named environment variable is set to a true
+// value such as "1" or "true". Unparseable values are fatal so that a typo
+// doesn't silently disable a setting.
+func envBool(name string) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %q", name, value)
+	}
+	return b
+}
+
+// envList splits the named environment variable at commas.
+func envList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envInt parses the named environment variable as a non-negative integer,
+// falling back to def when it is unset.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid value for %s: %q", name, value)
+	}
+	return n
+}
+
+// envDuration parses the named environment variable as a duration such as
+// "30s", falling back to def when it is unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid value for %s: %q", name, value)
+	}
+	return d
+}
+
+// envFileMode parses the named environment variable as an octal file mode
+// such as "0660", falling back to def when it is unset.
+func envFileMode(name string, def os.FileMode) os.FileMode {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		log.Fatalf("Invalid value for %s: %q", name, value)
 	}
+	return os.FileMode(mode)
 }
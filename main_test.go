@@ -0,0 +1,111 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		ipv6 bool
+	}{
+		{"IPv4", "127.0.0.1:0", false},
+		{"IPv6", "[::1]:0", true},
+		{"hostname", "localhost:0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("KEYSERVER_LISTEN_ADDR", tt.addr)
+			addr, err := listenAddr()
+			if err != nil {
+				t.Fatalf("listenAddr() with %s: %v", tt.addr, err)
+			}
+			if addr != tt.addr {
+				t.Fatalf("listenAddr() = %q, want %q", addr, tt.addr)
+			}
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				if tt.ipv6 {
+					t.Skipf("IPv6 not available: %v", err)
+				}
+				t.Fatalf("listening on %s: %v", addr, err)
+			}
+			listener.Close()
+		})
+	}
+}
+
+func TestListenAddrInvalid(t *testing.T) {
+	t.Setenv("KEYSERVER_LISTEN_ADDR", "127.0.0.1")
+	if addr, err := listenAddr(); err == nil {
+		t.Fatalf("listenAddr() = %q, want an error for an address without port", addr)
+	}
+}
+
+func TestListenAddrPort(t *testing.T) {
+	t.Setenv("KEYSERVER_LISTEN_ADDR", "")
+	t.Setenv("KEYSERVER_PORT", "9090")
+	addr, err := listenAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != ":9090" {
+		t.Fatalf("listenAddr() = %q, want %q", addr, ":9090")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{"example.com", 443, "https://example.com/keys/host?user=alice"},
+		{"example.com:8080", 443, "https://example.com/keys/host?user=alice"},
+		{"example.com", 8443, "https://example.com:8443/keys/host?user=alice"},
+		{"[::1]", 443, "https://[::1]/keys/host?user=alice"},
+		{"[::1]", 8443, "https://[::1]:8443/keys/host?user=alice"},
+		{"[::1]:8080", 8443, "https://[::1]:8443/keys/host?user=alice"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/keys/host?user=alice", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		redirectToHTTPS(tt.port).ServeHTTP(w, r)
+		if got := w.Header().Get("Location"); w.Code != http.StatusPermanentRedirect || got != tt.want {
+			t.Errorf("redirect of %s to port %d = %d %q, want %d %q", tt.host, tt.port, w.Code, got, http.StatusPermanentRedirect, tt.want)
+		}
+	}
+}
+
+func TestRedirectToHTTPSWithoutHost(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/keys/host", nil)
+	r.Host = ""
+	w := httptest.NewRecorder()
+	redirectToHTTPS(443).ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("redirect without host = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultMaintenanceRetryAfter is the Retry-After sent during maintenance
+// unless another one was asked for.
+const defaultMaintenanceRetryAfter = time.Minute
+
+// maintenanceState describes a pause of key distribution. It only lives in
+// memory, so a restart ends maintenance. It is replaced rather than changed,
+// so readers only hold maintenanceLock to get the pointer and can use the
+// state after releasing it.
+type maintenanceState struct {
+	Since      time.Time
+	RetryAfter time.Duration
+}
+
+type maintenanceResponse struct {
+	Maintenance       bool       `json:"maintenance"`
+	Since             *time.Time `json:"since,omitempty"`
+	RetryAfterSeconds int        `json:"retry_after_seconds,omitempty"`
+}
+
+// maintenanceMode returns the current maintenance, or nil if keys are being
+// served normally.
+func (s *Server) maintenanceMode() *maintenanceState {
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+	return s.maintenance
+}
+
+// maintenanceHandler shows (GET), starts (POST) and ends (DELETE) maintenance.
+// POST takes an optional retry_after parameter in seconds for the Retry-After
+// header sent to hosts.
+func (s *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		retryAfter := defaultMaintenanceRetryAfter
+		if value := r.URL.Query().Get("retry_after"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				http.Error(w, "Invalid retry_after", http.StatusBadRequest)
+				return
+			}
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		s.maintenanceLock.Lock()
+		since := time.Now()
+		if s.maintenance == nil {
+			logWarnf("Entering maintenance, key requests are answered with 503")
+		} else {
+			since = s.maintenance.Since
+		}
+		s.maintenance = &maintenanceState{Since: since, RetryAfter: retryAfter}
+		s.maintenanceLock.Unlock()
+	case http.MethodDelete:
+		s.maintenanceLock.Lock()
+		if s.maintenance != nil {
+			logWarnf("Leaving maintenance, serving keys again")
+			s.maintenance = nil
+		}
+		s.maintenanceLock.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp maintenanceResponse
+	if m := s.maintenanceMode(); m != nil {
+		resp.Maintenance = true
+		resp.Since = &m.Since
+		resp.RetryAfterSeconds = int(m.RetryAfter.Seconds())
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,253 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// watcherHeartbeatInterval is how often the file watchers report that they
+// are alive.
+const watcherHeartbeatInterval = 10 * time.Second
+
+// The metrics are served in the Prometheus text format at /metrics.
+var (
+	reloadDuration = newHistogramVec(
+		"keyserver_reload_duration_seconds",
+		"Time taken to load the config or the keyring.",
+		"source",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	)
+	keysServed = newCounterVec(
+		"keyserver_keys_served_total",
+		"Keys served to hosts, by key type.",
+		"type",
+	)
+	keyringInconsistencies = newCounterVec(
+		"keyserver_keyring_inconsistencies_total",
+		"Changes of the keyring the watcher missed, found by the consistency check, by source.",
+		"source",
+	)
+	watchersUp = newHeartbeatGauge(
+		"keyserver_watcher_up",
+		"Whether the file watcher is alive, by watcher.",
+		"watcher",
+		watcherHeartbeatInterval,
+	)
+)
+
+// metric is a metric family that can write itself in the Prometheus text
+// format.
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var registeredMetrics []metric
+
+// counterVec is a counter partitioned by the value of a single label.
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	lock   sync.Mutex
+	values map[string]uint64 // label value -> count
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]uint64),
+	}
+	registeredMetrics = append(registeredMetrics, c)
+	return c
+}
+
+// inc increments the counter for the given label value.
+func (c *counterVec) inc(labelValue string) {
+	c.lock.Lock()
+	c.values[labelValue]++
+	c.lock.Unlock()
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	labelValues := make([]string, 0, len(c.values))
+	for labelValue := range c.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, labelValue, c.values[labelValue])
+	}
+}
+
+// histogramVec is a histogram partitioned by the value of a single label.
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*histogramSeries // label value -> series
+}
+
+type histogramSeries struct {
+	counts []uint64 // observations per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	registeredMetrics = append(registeredMetrics, h)
+	return h
+}
+
+// observe records a value for the given label value.
+func (h *histogramVec) observe(labelValue string, v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	series, ok := h.series[labelValue]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = series
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += v
+	series.count++
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	labelValues := make([]string, 0, len(h.series))
+	for labelValue := range h.series {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		series := h.series[labelValue]
+		label := fmt.Sprintf("%s=%q", h.label, labelValue)
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", h.name, label, strconv.FormatFloat(upper, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, label, series.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, label, strconv.FormatFloat(series.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, label, series.count)
+	}
+}
+
+// heartbeatGauge is 1 for each label value whose owner beat within the last
+// few intervals and 0 once it stopped beating, e.g. because its goroutine
+// exited.
+type heartbeatGauge struct {
+	name     string
+	help     string
+	label    string
+	interval time.Duration
+
+	lock  sync.Mutex
+	beats map[string]time.Time // label value -> last beat
+}
+
+func newHeartbeatGauge(name, help, label string, interval time.Duration) *heartbeatGauge {
+	g := &heartbeatGauge{
+		name:     name,
+		help:     help,
+		label:    label,
+		interval: interval,
+		beats:    make(map[string]time.Time),
+	}
+	registeredMetrics = append(registeredMetrics, g)
+	return g
+}
+
+// beat records that the owner of the given label value is alive.
+func (g *heartbeatGauge) beat(labelValue string) {
+	g.lock.Lock()
+	g.beats[labelValue] = time.Now()
+	g.lock.Unlock()
+}
+
+func (g *heartbeatGauge) writeTo(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+
+	labelValues := make([]string, 0, len(g.beats))
+	for labelValue := range g.beats {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		up := 0
+		if time.Since(g.beats[labelValue]) < 3*g.interval {
+			up = 1
+		}
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", g.name, g.label, labelValue, up)
+	}
+}
+
+// metricsHandler serves all metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range registeredMetrics {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// shedLoad rejects requests with the overload response while
+// MaxConcurrentRequests requests are already being handled.
+func (s *Server) shedLoad(next http.HandlerFunc) http.HandlerFunc {
+	if s.inFlight == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case s.inFlight <- struct{}{}:
+			defer func() { <-s.inFlight }()
+			next(w, r)
+		default:
+			logDebugf("Shedding request for %s, %d requests in flight", r.URL.Path, s.opts.MaxConcurrentRequests)
+			s.writeOverloaded(w)
+		}
+	}
+}
+
+// shedGRPCLoad is shedLoad for gRPC calls, which share the limit with the
+// HTTP key requests and fail with Unavailable while it is reached.
+func (s *Server) shedGRPCLoad(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if s.inFlight == nil {
+		return handler(ctx, req)
+	}
+
+	select {
+	case s.inFlight <- struct{}{}:
+		defer func() { <-s.inFlight }()
+		return handler(ctx, req)
+	default:
+		logDebugf("Shedding call to %s, %d requests in flight", info.FullMethod, s.opts.MaxConcurrentRequests)
+		return nil, status.Error(codes.Unavailable, s.opts.OverloadMessage)
+	}
+}
+
+// writeOverloaded tells a client that the server is shedding load, so that
+// it backs off rather than treating the request as denied.
+func (s *Server) writeOverloaded(w http.ResponseWriter) {
+	if s.opts.OverloadRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.opts.OverloadRetryAfter.Seconds())))
+	}
+	http.Error(w, s.opts.OverloadMessage, s.opts.OverloadStatus)
+}
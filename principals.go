@@ -0,0 +1,59 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// principalsHandler serves the usernames assigned to a host, one per line,
+// for use with AuthorizedPrincipalsCommand in setups with an SSH CA. Unlike
+// /keys it includes users who have no keys in the keyring.
+func (s *Server) principalsHandler(w http.ResponseWriter, r *http.Request) {
+	_, hostname, username, hostConfig, ok := s.authorizeHost(w, r, "/principals/")
+	if !ok {
+		return
+	}
+
+	var principals []string
+	switch {
+	case hostConfig.Lockdown:
+	case username != "":
+		if !s.isUserAuthorized(hostname, username) {
+			http.Error(w, "User not authorized for host", http.StatusForbidden)
+			return
+		}
+		principals = []string{username}
+	default:
+		s.configLock.RLock()
+		for user := range s.hostUsers(hostConfig) {
+			principals = append(principals, user)
+		}
+		s.configLock.RUnlock()
+		sort.Strings(principals)
+	}
+
+	logDebugf("Serving %d principals for %s", len(principals), hostname)
+	w.Header().Set("Content-Type", "text/plain")
+	for _, principal := range principals {
+		fmt.Fprintln(w, principal)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// queryKeys writes the keys a host would get to w, checking the token like
+// a request would. It backs the -query flag.
+func (s *Server) queryKeys(w io.Writer, hostname, token string) error {
+	if !validHostname(hostname) {
+		return errors.New("invalid hostname")
+	}
+	hostname, hostConfig, exists := s.resolveHost(hostname)
+	if !exists {
+		return errors.New("host not found")
+	}
+	if !s.validateTokens(hostname, token) {
+		return errors.New("invalid token")
+	}
+	if hostConfig.Lockdown {
+		return nil
+	}
+
+	users := s.getUsersForHost(hostname)
+	if len(users) == 0 {
+		if s.opts.AllowEmpty {
+			return nil
+		}
+		return errors.New("host has no valid users")
+	}
+	keys := s.collectKeys(hostname, users).keys
+	if strings.TrimSpace(keys) == "" && !s.opts.AllowEmpty {
+		return errors.New("host has no valid keys")
+	}
+	_, err := fmt.Fprint(w, keys)
+	return err
+}
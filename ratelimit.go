@@ -0,0 +1,106 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxTrackedHosts bounds the number of hosts whose rate limiters and last
+// served times are kept. Hosts served through the default entry can be made
+// up by anyone with its token, so these maps can't grow with every name.
+const maxTrackedHosts = 100000
+
+// hostLimiter is the rate limiter of a host along with the limit it was
+// created for, so that it is replaced when the limit changes.
+type hostLimiter struct {
+	limit   int
+	limiter *rate.Limiter
+}
+
+// rateLimit returns the number of key requests per minute a host may make,
+// or 0 if it isn't limited. The host's rate_limit overrides the global
+// limit, and a negative rate_limit lifts it.
+func (s *Server) rateLimit(hostConfig HostConfig) int {
+	switch {
+	case hostConfig.RateLimit < 0:
+		return 0
+	case hostConfig.RateLimit > 0:
+		return hostConfig.RateLimit
+	}
+	return s.opts.RateLimit
+}
+
+// allowRequest takes a request from the host's rate limit. If the host is
+// over its limit, it returns how long the host should wait instead.
+func (s *Server) allowRequest(hostname string, hostConfig HostConfig) (time.Duration, bool) {
+	limit := s.rateLimit(hostConfig)
+	if limit <= 0 {
+		return 0, true
+	}
+
+	s.limitersLock.Lock()
+	l, ok := s.limiters[hostname]
+	if !ok || l.limit != limit {
+		if !ok && len(s.limiters) >= maxTrackedHosts {
+			s.pruneLimiters()
+		}
+		// A minute's worth of requests may come at once
+		l = hostLimiter{limit: limit, limiter: rate.NewLimiter(rate.Limit(float64(limit)/60), limit)}
+		s.limiters[hostname] = l
+	}
+	s.limitersLock.Unlock()
+
+	reservation := l.limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return delay, false
+	}
+	return 0, true
+}
+
+// pruneLimiters makes room for a new rate limiter by dropping the limiters
+// that are full again, which a host would get anew anyway. If every host
+// used up some of its limit in the last minute, an arbitrary one is dropped.
+// The caller must hold limitersLock.
+func (s *Server) pruneLimiters() {
+	for hostname, l := range s.limiters {
+		if l.limiter.Tokens() >= float64(l.limit) {
+			delete(s.limiters, hostname)
+		}
+	}
+	for hostname := range s.limiters {
+		if len(s.limiters) < maxTrackedHosts {
+			break
+		}
+		delete(s.limiters, hostname)
+	}
+}
+
+// writeRateLimited tells a host that it is over its rate limit and when to
+// try again.
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+}
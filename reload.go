@@ -0,0 +1,161 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// reloadCoalesceWindow is how long reload requests are collected before
+// they are run, so that a deploy touching both the config and the keyring
+// causes one reload rather than two.
+const reloadCoalesceWindow = 500 * time.Millisecond
+
+// What to reload, see requestReload.
+const (
+	reloadConfig = 1 << iota
+	reloadKeyring
+)
+
+// requestReload schedules a reload of what, joining any reload that is
+// already scheduled.
+func (s *Server) requestReload(what int) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	s.pendingReloads |= what
+	if !s.reloadScheduled {
+		s.reloadScheduled = true
+		time.AfterFunc(reloadCoalesceWindow, func() { s.runReloads() })
+	}
+}
+
+// takeReloads returns and clears the pending reloads in mask.
+func (s *Server) takeReloads(mask int) int {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	pending := s.pendingReloads & mask
+	s.pendingReloads &^= mask
+	return pending
+}
+
+// runReloads runs the pending reloads and sends a single notification for
+// all of them. It returns what was reloaded and the errors of what failed.
+func (s *Server) runReloads() ([]string, error) {
+	s.reloadRunLock.Lock()
+	defer s.reloadRunLock.Unlock()
+
+	s.reloadLock.Lock()
+	s.reloadScheduled = false
+	s.reloadLock.Unlock()
+
+	var reloaded []string
+	var errs []error
+	if s.takeReloads(reloadConfig) != 0 {
+		if err := s.loadConfig(); err != nil {
+			logErrorf("Error reloading config: %v", err)
+			errs = append(errs, fmt.Errorf("error reloading config: %v", err))
+		} else {
+			logInfof("Config reloaded successfully")
+			reloaded = append(reloaded, "config")
+		}
+	}
+
+	// Taken after the config, which may have asked for a keyring reload
+	if s.takeReloads(reloadKeyring) != 0 {
+		if err := s.userKeys.loadAllKeys(); err != nil {
+			logErrorf("Error reloading keyring: %v", err)
+			errs = append(errs, fmt.Errorf("error reloading keyring: %v", err))
+		} else {
+			logInfof("Keyring reloaded successfully")
+			reloaded = append(reloaded, "keyring")
+		}
+	}
+
+	if len(reloaded) > 0 {
+		s.reloaded(strings.Join(reloaded, ","))
+	}
+	return reloaded, errors.Join(errs...)
+}
+
+type reloadResponse struct {
+	Reloaded []string `json:"reloaded"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// reloadHandler reloads the config and the keyring right away, or only one
+// of them with ?scope=config or ?scope=keyring, e.g. to skip an expensive
+// keyring rescan after a config change.
+func (s *Server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.opts.UpstreamURL != "" {
+		http.Error(w, "Replicas reload from upstream", http.StatusConflict)
+		return
+	}
+
+	var what int
+	switch scope := r.URL.Query().Get("scope"); scope {
+	case "":
+		what = reloadConfig | reloadKeyring
+	case "config":
+		what = reloadConfig
+	case "keyring":
+		what = reloadKeyring
+	default:
+		http.Error(w, "Invalid scope, expected config or keyring", http.StatusBadRequest)
+		return
+	}
+
+	// Stdin was consumed at startup, reading it again would replace the
+	// config with an empty one
+	if s.configPath == "-" {
+		if what == reloadConfig {
+			http.Error(w, "Configs from stdin are only read at startup", http.StatusConflict)
+			return
+		}
+		what &^= reloadConfig
+	}
+
+	s.reloadLock.Lock()
+	s.pendingReloads |= what
+	s.reloadLock.Unlock()
+
+	reloaded, err := s.runReloads()
+	resp := reloadResponse{Reloaded: reloaded}
+	if resp.Reloaded == nil {
+		resp.Reloaded = []string{}
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,118 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportResponse is the full state a replica pulls from its upstream.
+type exportResponse struct {
+	Config      Config              `json:"config"`
+	LDAPMembers map[string][]string `json:"ldap_members"`
+	Keys        map[string][]Key    `json:"keys"`
+
+	// Subtrees are the keyrings of the subdirectories used by hosts with
+	// keyring_subdir, by subdirectory.
+	Subtrees map[string]map[string][]Key `json:"subtrees,omitempty"`
+}
+
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.configLock.RLock()
+	export := exportResponse{
+		Config:      s.config,
+		LDAPMembers: s.ldapMembers,
+	}
+	s.configLock.RUnlock()
+	export.Keys = s.userKeys.AllKeys()
+	export.Subtrees = s.userKeys.AllSubtrees()
+
+	writeJSON(w, export)
+}
+
+// startReplica performs the initial pull from upstream and keeps pulling in
+// the background.
+func (s *Server) startReplica() error {
+	s.userKeys = &UserKeys{
+		keyring: make(map[string][]Key),
+		skipped: make(map[string]int),
+	}
+
+	if err := s.pullUpstream(); err != nil {
+		return fmt.Errorf("failed to pull from upstream: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.opts.UpstreamInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := s.pullUpstream(); err != nil {
+				logErrorf("Error pulling from upstream: %v", err)
+			} else {
+				s.reloaded("upstream")
+			}
+		}
+	}()
+
+	return nil
+}
+
+// pullUpstream fetches the config and keyring of the upstream keyserver.
+func (s *Server) pullUpstream() error {
+	url := strings.TrimSuffix(s.opts.UpstreamURL, "/") + "/export"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+s.opts.UpstreamToken)
+
+	resp, err := s.fetchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", url, resp.Status)
+	}
+
+	var export exportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		return fmt.Errorf("error parsing upstream state: %v", err)
+	}
+
+	s.configLock.Lock()
+	s.config = export.Config
+	s.configLoaded = time.Now()
+	s.ldapMembers = export.LDAPMembers
+	s.configLock.Unlock()
+	s.userKeys.setKeyring(export.Keys, export.Subtrees)
+
+	logDebugf("Pulled config and keys from %s", s.opts.UpstreamURL)
+	return nil
+}
@@ -19,43 +19,283 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
-	"log"
+	"io/fs"
+	"mime"
 	"net/http"
-	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sync/singleflight"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Hosts  map[string]HostConfig  `yaml:"hosts"`
-	Groups map[string]GroupConfig `yaml:"groups"`
+	Include      []string               `yaml:"include,omitempty"`
+	Hosts        map[string]HostConfig  `yaml:"hosts"`
+	Groups       map[string]GroupConfig `yaml:"groups"`
+	MaxKeyAge    time.Duration          `yaml:"max_key_age,omitempty"`
+	KeyOrder     string                 `yaml:"key_order,omitempty"`
+	DefaultToken string                 `yaml:"default_token,omitempty"`
+	AllowedUsers []string               `yaml:"allowed_users,omitempty"`
+
+	// WarnUnknownFiles warns about files in user directories that aren't
+	// loaded, e.g. a key misnamed id_ed25519.pub.txt.
+	WarnUnknownFiles bool `yaml:"warn_unknown_files,omitempty"`
 }
 
+// Orders in which the keys of a user are served.
+const (
+	keyOrderType = "type" // grouped by key type
+	keyOrderFile = "file" // by key file name, e.g. 01-primary.pub first
+)
+
 type HostConfig struct {
-	Token  string   `yaml:"token"`
-	Users  []string `yaml:"users"`
-	Groups []string `yaml:"groups"`
+	Token        string   `yaml:"token"`
+	Users        []string `yaml:"users"`
+	Groups       []string `yaml:"groups"`
+	CacheControl string   `yaml:"cache_control,omitempty"`
+	Filename     string   `yaml:"filename,omitempty"`
+	RateLimit    int      `yaml:"rate_limit,omitempty"`
+
+	// CommentFilter limits the keys served to the host to those whose
+	// comment matches, e.g. to give CI hosts only deploy keys.
+	CommentFilter *Pattern `yaml:"comment_filter,omitempty"`
+
+	// PreviousToken keeps being accepted after a token rotation until
+	// PreviousTokenExpires, giving hosts time to pick up the new token.
+	PreviousToken        string    `yaml:"previous_token,omitempty"`
+	PreviousTokenExpires time.Time `yaml:"previous_token_expires,omitempty"`
+
+	// Lockdown serves an empty key list with 200 to lock everyone out of the
+	// host.
+	Lockdown bool `yaml:"lockdown,omitempty"`
+
+	// AllowCertificates serves SSH certificates found in the keyring to
+	// the host, as long as they are valid.
+	AllowCertificates bool `yaml:"allow_certificates,omitempty"`
+
+	// KeyringSubdir limits the host to the users of this subdirectory of
+	// the keyring, e.g. to keep tenants apart.
+	KeyringSubdir string `yaml:"keyring_subdir,omitempty"`
+
+	// Restrictions replace the options of every key served to the host.
+	Restrictions *Restrictions `yaml:"restrictions,omitempty"`
+
+	// MaxKeys limits how many keys the host gets, for clients that can't
+	// handle large authorized_keys files. Further keys are dropped.
+	MaxKeys int `yaml:"max_keys,omitempty"`
+
+	// RewriteComments replaces the comment of every key with
+	// <username>@keyserver.
+	RewriteComments bool `yaml:"rewrite_comments,omitempty"`
+
+	// CommentRules rewrite the comments of the keys served to the host, to
+	// keep internal details like IPs or ticket numbers from leaking.
+	CommentRules []CommentRule `yaml:"comment_rules,omitempty"`
+
+	// LineEnding terminates every key line served to the host, "lf" by
+	// default or "crlf" for Windows hosts.
+	LineEnding string `yaml:"line_ending,omitempty"`
+}
+
+// Line endings of the keys served to a host.
+const (
+	lineEndingLF   = "lf"
+	lineEndingCRLF = "crlf"
+)
+
+// lineTerminator returns the characters that end every key line served to
+// the host.
+func (h HostConfig) lineTerminator() string {
+	if h.LineEnding == lineEndingCRLF {
+		return "\r\n"
+	}
+	return "\n"
 }
 
 type GroupConfig struct {
-	Users []string `yaml:"users"`
+	Users  []string    `yaml:"users"`
+	Groups []string    `yaml:"groups,omitempty"` // groups whose members belong to this group too
+	LDAP   *LDAPSource `yaml:"ldap,omitempty"`
+}
+
+// Options holds the server settings that are read from the environment.
+type Options struct {
+	// AllowEmpty serves hosts without any valid keys with 200 and an empty
+	// body instead of 404.
+	AllowEmpty bool
+
+	// AdminToken protects the admin endpoints. They are disabled when empty.
+	AdminToken string
+	// CORSOrigins are the origins allowed to call the admin endpoints from a
+	// browser. "*" allows any origin.
+	CORSOrigins []string
+
+	// AllowQueryToken accepts the host token in a "token" query parameter
+	// for clients that can't send an Authorization header.
+	AllowQueryToken bool
+
+	// DecodeTokens compares tokens of the form "v2:<base64>" by their
+	// decoded value, so that hosts can send either form.
+	DecodeTokens bool
+
+	// ContentType is the Content-Type of served keys.
+	ContentType string
+
+	// CacheControl is the default Cache-Control header for served keys.
+	// Hosts can override it with cache_control.
+	CacheControl string
+
+	// Filename, if set, is sent in a Content-Disposition header so that
+	// clients saving the keys to a file name it accordingly. Hosts can
+	// override it with filename.
+	Filename string
+
+	// ConfigOverlay is a config file that is deep-merged into the main
+	// config, e.g. with the settings of one environment.
+	ConfigOverlay string
+
+	// LowercaseUsernames converts the usernames of the config and of
+	// requests to lower case. The keyring's are converted by
+	// Keyring.NormalizeUsername.
+	LowercaseUsernames bool
+
+	// HostFromSNI identifies hosts by the server name they send in the TLS
+	// handshake instead of by the request path.
+	HostFromSNI bool
+
+	// Keyring configures how the keyring is loaded.
+	Keyring KeyringOptions
+
+	// MaxHosts and MaxGroups flag configs with more hosts or groups than
+	// expected, which usually means a bug in whatever generated them.
+	// Exceeding them is only logged unless EnforceLimits is set.
+	MaxHosts      int
+	MaxGroups     int
+	EnforceLimits bool
+
+	// WebhookURL receives a POST after every successful reload.
+	WebhookURL string
+
+	// MaxConcurrentRequests limits how many key requests are handled at
+	// once. Requests beyond it get the overload response: OverloadStatus
+	// with OverloadMessage as body and, if set, a Retry-After header of
+	// OverloadRetryAfter.
+	MaxConcurrentRequests int
+	OverloadStatus        int
+	OverloadMessage       string
+	OverloadRetryAfter    time.Duration
+
+	// RateLimit is the number of key requests per minute a host may make,
+	// unless it has its own rate_limit. 0 means no limit.
+	RateLimit int
+
+	// Warmup is how long after startup keys are answered with 503, giving
+	// files that are still being synced time to arrive.
+	Warmup time.Duration
+
+	// Files, if set, holds the config and the keyring instead of the file
+	// system, e.g. files embedded in the binary. Neither is reloaded then.
+	Files fs.FS
+
+	// KeyringMaxAge, if set, answers key requests with 503 once the keyring
+	// hasn't been loaded successfully for this long, rather than serving
+	// keys that may be stale. The keyring is rescanned at half this
+	// interval so that it only ages when loading fails.
+	KeyringMaxAge time.Duration
+
+	// HostKeyringPath, if set, is a directory of host public keys laid out
+	// like the keyring, which are served as known_hosts entries.
+	HostKeyringPath string
+
+	// MinUsers keeps the server not ready until at least this many users
+	// with keys were loaded, so that a keyring that is still being synced
+	// isn't served to the whole fleet.
+	MinUsers int
+
+	// FetchConnectTimeout and FetchTimeout bound connecting to and talking
+	// to network sources while loading, so that a hung server can't block
+	// reloads. They default to 5 and 10 seconds.
+	FetchConnectTimeout time.Duration
+	FetchTimeout        time.Duration
+
+	// UpstreamURL turns the server into a read-only replica that pulls its
+	// config and keyring from the primary keyserver at this URL instead of
+	// reading local files.
+	UpstreamURL string
+	// UpstreamToken is the admin token of the upstream keyserver.
+	UpstreamToken string
+	// UpstreamInterval is how often the replica pulls from upstream.
+	UpstreamInterval time.Duration
 }
 
 type Server struct {
-	config     Config
-	configLock sync.RWMutex
-	configPath string
-	userKeys   *UserKeys
+	config        Config
+	configLock    sync.RWMutex
+	configPath    string
+	configWatcher *fsnotify.Watcher
+	configLoaded  time.Time
+	ldapMembers   map[string][]string // group name -> members resolved from LDAP
+	userKeys      *UserKeys
+	hostKeys      *UserKeys // nil unless HostKeyringPath is set
+	opts          Options
+	startedAt     time.Time
+	inFlight      chan struct{} // semaphore of key requests being handled
+
+	lastServed     map[string]time.Time // hostname -> time keys were last served
+	lastServedLock sync.Mutex
+
+	timesServed     map[string]uint64 // username -> number of responses their keys were in
+	timesServedLock sync.Mutex
+
+	noKeysLogged     map[string]bool // users reported without keys since the last reload
+	noKeysLoggedLock sync.Mutex
+
+	tooFewUsers     bool // whether fewer than MinUsers users were loaded when last checked
+	tooFewUsersLock sync.Mutex
+
+	pendingReloads  int // reloadConfig and reloadKeyring bits
+	reloadScheduled bool
+	reloadLock      sync.Mutex
+	reloadRunLock   sync.Mutex // held while reloads run, so they never overlap
+
+	maintenance     *maintenanceState // nil unless key distribution is paused
+	maintenanceLock sync.Mutex
+
+	limiters     map[string]hostLimiter // hostname -> rate limiter
+	limitersLock sync.Mutex
+
+	keyRequests singleflight.Group // key requests in flight, by host, user and group
+
+	fetchClient *http.Client // for the config URL and the upstream of a replica
 }
 
-func NewServer(configPath string, keyringPath string) (*Server, error) {
+func NewServer(configPath string, keyringPath string, opts Options) (*Server, error) {
 	s := &Server{
-		configPath: configPath,
+		configPath:   configPath,
+		opts:         opts,
+		startedAt:    time.Now(),
+		lastServed:   make(map[string]time.Time),
+		limiters:     make(map[string]hostLimiter),
+		timesServed:  make(map[string]uint64),
+		noKeysLogged: make(map[string]bool),
+	}
+
+	s.fetchClient = s.newFetchClient()
+
+	if opts.MaxConcurrentRequests > 0 {
+		s.inFlight = make(chan struct{}, opts.MaxConcurrentRequests)
+	}
+
+	if opts.UpstreamURL != "" {
+		return s, s.startReplica()
 	}
 
 	if err := s.loadConfig(); err != nil {
@@ -63,39 +303,113 @@ func NewServer(configPath string, keyringPath string) (*Server, error) {
 	}
 
 	// Initialize key cache
-	userKeys, err := NewUserKeys(keyringPath)
+	keyringOpts := opts.Keyring
+	keyringOpts.OnChange = func() { s.requestReload(reloadKeyring) }
+	keyringOpts.AllowUser = s.userAllowed
+	keyringOpts.Subtrees = s.keyringSubdirs
+	keyringOpts.WarnUnknownFiles = s.warnUnknownFiles
+	if opts.KeyringMaxAge > 0 {
+		keyringOpts.RescanInterval = opts.KeyringMaxAge / 2
+	}
+	userKeys, err := NewUserKeys(keyringPath, keyringOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize key cache: %v", err)
 	}
 	s.userKeys = userKeys
 
-	// Setup config file watcher
-	if err := s.watchConfig(); err != nil {
-		return nil, fmt.Errorf("failed to setup config watcher: %v", err)
+	if opts.HostKeyringPath != "" {
+		if err := s.loadHostKeys(opts.HostKeyringPath); err != nil {
+			return nil, fmt.Errorf("failed to initialize host key cache: %v", err)
+		}
+	}
+
+	// Setup config file watcher. Configs from stdin, a URL or embedded files
+	// are only read at startup.
+	if s.configIsFile() && opts.Files == nil {
+		if err := s.watchConfig(); err != nil {
+			return nil, fmt.Errorf("failed to setup config watcher: %v", err)
+		}
 	}
 
 	return s, nil
 }
 
 func (s *Server) loadConfig() error {
-	data, err := os.ReadFile(s.configPath)
+	start := time.Now()
+	defer func() { reloadDuration.observe("config", time.Since(start).Seconds()) }()
+
+	data, err := s.readConfig()
 	if err != nil {
 		return fmt.Errorf("error reading config file: %v", err)
 	}
 
 	var newConfig Config
-	if err := yaml.Unmarshal(data, &newConfig); err != nil {
+	if err := yaml.UnmarshalStrict(data, &newConfig); err != nil {
 		return fmt.Errorf("error parsing config file: %v", err)
 	}
 
+	if err := s.mergeIncludes(&newConfig); err != nil {
+		return err
+	}
+
+	// The overlay applies to the combined config, so that it can also
+	// override what included files define
+	if s.opts.ConfigOverlay != "" {
+		if newConfig, err = s.applyOverlay(newConfig); err != nil {
+			return err
+		}
+	}
+
+	if err := s.validateConfig(newConfig); err != nil {
+		return err
+	}
+
+	ldapMembers := s.resolveLDAPGroups(newConfig)
+	if s.opts.LowercaseUsernames {
+		lowercaseUsers(&newConfig)
+		for group, members := range ldapMembers {
+			ldapMembers[group] = lowercaseAll(members)
+		}
+	}
+
 	s.configLock.Lock()
+	keyringChanged := !slices.Equal(s.config.AllowedUsers, newConfig.AllowedUsers) ||
+		!slices.Equal(keyringSubdirs(s.config), keyringSubdirs(newConfig)) ||
+		s.config.WarnUnknownFiles != newConfig.WarnUnknownFiles
 	s.config = newConfig
+	s.configLoaded = time.Now()
+	s.ldapMembers = ldapMembers
 	s.configLock.Unlock()
 
-	log.Printf("Config loaded successfully from %s", s.configPath)
+	logInfof("Config loaded successfully from %s", s.configPath)
+	s.watchIncludes()
+
+	// The keyring only holds allowed users and the subdirectories hosts
+	// use, so it has to follow changes, and it warns about unknown files
+	// only when asked to
+	if keyringChanged && s.userKeys != nil {
+		s.requestReload(reloadKeyring)
+	}
 	return nil
 }
 
+// warnUnknownFiles reports whether unknown files in the keyring are warned
+// about.
+func (s *Server) warnUnknownFiles() bool {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	return s.config.WarnUnknownFiles
+}
+
+// userAllowed reports whether a user may be loaded from the keyring at all.
+func (s *Server) userAllowed(username string) bool {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	return len(s.config.AllowedUsers) == 0 || slices.Contains(s.config.AllowedUsers, username)
+}
+
 func (s *Server) watchConfig() error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -105,33 +419,44 @@ func (s *Server) watchConfig() error {
 	go func() {
 		// Use a timer to debounce rapid file changes
 		var debounceTimer *time.Timer
+		heartbeat := time.NewTicker(watcherHeartbeatInterval)
+		defer heartbeat.Stop()
+		watchersUp.beat("config")
 		for {
 			select {
+			case <-heartbeat.C:
+				watchersUp.beat("config")
 			case event, ok := <-watcher.Events:
 				if !ok {
 					return
 				}
-				if event.Has(fsnotify.Write) {
+				configChanged := (event.Name == s.configPath || event.Name == s.opts.ConfigOverlay) && event.Has(fsnotify.Write)
+				includeChanged := s.isIncluded(event.Name) && event.Has(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename)
+				if configChanged || includeChanged {
 					if debounceTimer != nil {
 						debounceTimer.Stop()
 					}
 					debounceTimer = time.AfterFunc(1000*time.Millisecond, func() {
-						if err := s.loadConfig(); err != nil {
-							log.Printf("Error reloading config: %v", err)
-						} else {
-							log.Printf("Config reloaded successfully")
-						}
+						s.requestReload(reloadConfig)
 					})
 				}
 			case err, ok := <-watcher.Errors:
 				if !ok {
 					return
 				}
-				log.Printf("Config watcher error: %v", err)
+				logErrorf("Config watcher error: %v", err)
 			}
 		}
 	}()
 
+	s.configWatcher = watcher
+	s.watchIncludes()
+
+	if s.opts.ConfigOverlay != "" {
+		if err := watcher.Add(s.opts.ConfigOverlay); err != nil {
+			return err
+		}
+	}
 	return watcher.Add(s.configPath)
 }
 
@@ -143,7 +468,57 @@ func (s *Server) validateToken(hostname, token string) bool {
 	if !exists {
 		return false
 	}
-	return hostConfig.Token == token
+	expected := hostConfig.Token
+	if expected == "" {
+		expected = s.config.DefaultToken
+	}
+	if s.tokensMatch(expected, token) {
+		return true
+	}
+	if hostConfig.PreviousToken != "" && time.Now().Before(hostConfig.PreviousTokenExpires) && s.tokensMatch(hostConfig.PreviousToken, token) {
+		logDebugf("Host %s used its previous token, which expires %s", hostname, hostConfig.PreviousTokenExpires.Format(time.RFC3339))
+		return true
+	}
+	return false
+}
+
+// tokensMatch compares a token from a request with one from the config,
+// which may be a hash of the token. Empty tokens, also after decoding,
+// never match, so that hosts without a token can't be accessed.
+func (s *Server) tokensMatch(expected, token string) bool {
+	if s.opts.DecodeTokens {
+		token = decodeToken(token)
+	}
+	if expected == "" || token == "" {
+		return false
+	}
+	if tokenHashed(expected) {
+		return hashMatches(expected, token)
+	}
+	if s.opts.DecodeTokens {
+		if expected = decodeToken(expected); expected == "" {
+			return false
+		}
+	}
+	return expected == token
+}
+
+// v2TokenPrefix marks tokens that are distributed base64-encoded.
+const v2TokenPrefix = "v2:"
+
+// decodeToken returns the secret a token stands for: the decoded value of a
+// "v2:<base64>" token, or the token itself. Tokens that don't decode are
+// returned as they are.
+func decodeToken(token string) string {
+	encoded, ok := strings.CutPrefix(token, v2TokenPrefix)
+	if !ok {
+		return token
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return token
+	}
+	return string(decoded)
 }
 
 func (s *Server) getUsersForHost(hostname string) []string {
@@ -155,6 +530,65 @@ func (s *Server) getUsersForHost(hostname string) []string {
 		return nil
 	}
 
+	uniqueUsers := s.hostUsers(hostConfig)
+
+	users := make([]string, 0, len(uniqueUsers))
+	for user := range uniqueUsers {
+		// Use UserKeys object to validate if user has keys
+		if keys := s.userKeysForHost(hostConfig, user); len(keys) > 0 {
+			users = append(users, user)
+		} else {
+			s.logNoKeys(user)
+		}
+	}
+
+	sort.Strings(users)
+
+	logDebugf("Found %d users for %s: %v", len(users), hostname, users)
+	return users
+}
+
+// logNoKeys reports a user without valid keys. Every user is only reported
+// once per reload, as the same users would otherwise be logged on every
+// request.
+func (s *Server) logNoKeys(user string) {
+	s.noKeysLoggedLock.Lock()
+	defer s.noKeysLoggedLock.Unlock()
+
+	if !s.noKeysLogged[user] {
+		s.noKeysLogged[user] = true
+		logInfof("No valid keys found for user %s", user)
+	}
+}
+
+// reloaded is called after trigger was reloaded successfully.
+func (s *Server) reloaded(trigger string) {
+	s.noKeysLoggedLock.Lock()
+	s.noKeysLogged = make(map[string]bool)
+	s.noKeysLoggedLock.Unlock()
+
+	s.notifyReload(trigger)
+}
+
+// userKeysForHost returns the keys of a user from the keyring the host uses.
+func (s *Server) userKeysForHost(hostConfig HostConfig, username string) []Key {
+	if hostConfig.KeyringSubdir != "" {
+		return s.userKeys.GetSubtreeUserKeys(hostConfig.KeyringSubdir, username)
+	}
+	return s.userKeys.GetUserKeys(username)
+}
+
+// keyringSubdirs returns the keyring subdirectories used by hosts, sorted.
+func (s *Server) keyringSubdirs() []string {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	return keyringSubdirs(s.config)
+}
+
+// hostUsers returns all users assigned to a host, directly or through
+// groups, whether they have keys or not. The caller must hold configLock.
+func (s *Server) hostUsers(hostConfig HostConfig) map[string]bool {
 	uniqueUsers := make(map[string]bool)
 
 	// Add direct users
@@ -163,94 +597,603 @@ func (s *Server) getUsersForHost(hostname string) []string {
 	}
 
 	// Add users from groups
+	visited := make(map[string]bool)
 	for _, groupName := range hostConfig.Groups {
-		if groupConfig, exists := s.config.Groups[groupName]; exists {
-			for _, user := range groupConfig.Users {
-				uniqueUsers[user] = true
-			}
-		}
+		s.addGroupUsers(uniqueUsers, groupName, visited)
 	}
 
-	users := make([]string, 0, len(uniqueUsers))
-	for user := range uniqueUsers {
-		// Use UserKeys object to validate if user has keys
-		if keys := s.userKeys.GetUserKeys(user); len(keys) > 0 {
-			users = append(users, user)
-		} else {
-			log.Printf("No valid keys found for user %s", user)
-		}
+	return uniqueUsers
+}
+
+// hostGroupMembers returns the members of a group that is assigned to a
+// host, directly or through another group. ok is false if it isn't.
+func (s *Server) hostGroupMembers(hostname, group string) (members map[string]bool, ok bool) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	if _, exists := s.config.Groups[group]; !exists {
+		return nil, false
+	}
+	assigned := make(map[string]bool)
+	for _, groupName := range s.config.Hosts[hostname].Groups {
+		s.addGroupUsers(make(map[string]bool), groupName, assigned)
+	}
+	if !assigned[group] {
+		return nil, false
 	}
 
-	log.Printf("Found %d users for %s: %v", len(users), hostname, users)
-	return users
+	members = make(map[string]bool)
+	s.addGroupUsers(members, group, make(map[string]bool))
+	return members, true
+}
+
+// addGroupUsers adds the members of a group, including those of the groups
+// it contains, to users. Groups in visited are skipped, which also breaks
+// cycles. The caller must hold configLock.
+func (s *Server) addGroupUsers(users map[string]bool, groupName string, visited map[string]bool) {
+	if visited[groupName] {
+		return
+	}
+	visited[groupName] = true
+
+	groupConfig, exists := s.config.Groups[groupName]
+	if !exists {
+		return
+	}
+	for _, user := range groupConfig.Users {
+		users[user] = true
+	}
+	for _, user := range s.ldapMembers[groupName] {
+		users[user] = true
+	}
+	for _, member := range groupConfig.Groups {
+		s.addGroupUsers(users, member, visited)
+	}
+}
+
+// isUserAuthorized reports whether a user is assigned to a host.
+func (s *Server) isUserAuthorized(hostname, username string) bool {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	hostConfig, exists := s.config.Hosts[hostname]
+	if !exists {
+		return false
+	}
+	return s.hostUsers(hostConfig)[username]
+}
+
+// keySet holds the keys a host gets, along with what is needed to count
+// them as served.
+type keySet struct {
+	keys  string
+	types []string // type of every key, for keysServed
+	users []string // users with at least one key, for countServed
 }
 
-func (s *Server) getKeysForUsers(users []string) string {
+// countKeySet records that the keys of set were served.
+func (s *Server) countKeySet(set keySet) {
+	for _, keyType := range set.types {
+		keysServed.inc(keyType)
+	}
+	for _, username := range set.users {
+		s.countServed(username)
+	}
+}
+
+// collectKeys returns the keys of users that a host gets, without counting
+// them as served.
+func (s *Server) collectKeys(hostname string, users []string) keySet {
 	s.configLock.RLock()
 	defer s.configLock.RUnlock()
 
+	hostConfig := s.config.Hosts[hostname]
+
+	terminator := hostConfig.lineTerminator()
+	var set keySet
 	var keys strings.Builder
+	var count, dropped int
 	for _, username := range users {
-		userKeys := s.userKeys.GetUserKeys(username)
+		userCount := count
+		// Keys are loaded in file name order. Unless that order is wanted,
+		// order them by type for a stable, diff-friendly response.
+		userKeys := s.userKeysForHost(hostConfig, username)
+		if s.config.KeyOrder != keyOrderFile {
+			userKeys = slices.Clone(userKeys)
+			slices.SortStableFunc(userKeys, func(a, b Key) int {
+				return strings.Compare(a.Type, b.Type)
+			})
+		}
 		for _, key := range userKeys {
-			keys.WriteString(key)
+			if s.config.MaxKeyAge > 0 && time.Since(key.ModTime) > s.config.MaxKeyAge {
+				logDebugf("Not serving expired key of user %s (modified %s)", username, key.ModTime.Format(time.RFC3339))
+				continue
+			}
+			if key.Certificate && !hostConfig.AllowCertificates {
+				logDebugf("Not serving certificate of user %s, %s doesn't allow certificates", username, hostname)
+				continue
+			}
+			if !key.Valid(time.Now()) {
+				logDebugf("Not serving certificate of user %s outside its validity period", username)
+				continue
+			}
+			if hostConfig.CommentFilter != nil && !hostConfig.CommentFilter.MatchString(key.Comment()) {
+				logDebugf("Not serving key of user %s, its comment doesn't match the filter of %s", username, hostname)
+				continue
+			}
+			// Emit every non-empty line exactly once with the host's line
+			// terminator, no matter how the key file was formatted
+			for _, line := range strings.Split(key.Line, "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" {
+					continue
+				}
+				if hostConfig.Restrictions != nil {
+					restricted, err := restrictKey(line, hostConfig.Restrictions)
+					if err != nil {
+						logWarnf("Not serving key of user %s to %s: %v", username, hostname, err)
+						continue
+					}
+					line = restricted
+				}
+				if hostConfig.MaxKeys > 0 && count >= hostConfig.MaxKeys {
+					dropped++
+					continue
+				}
+				if len(hostConfig.CommentRules) > 0 {
+					line = sanitizeComment(line, hostConfig.CommentRules)
+				}
+				if hostConfig.RewriteComments {
+					line = rewriteComment(line, username)
+				}
+				keys.WriteString(line)
+				keys.WriteString(terminator)
+				set.types = append(set.types, key.Type)
+				count++
+			}
 		}
+		if count > userCount {
+			set.users = append(set.users, username)
+		}
+	}
+
+	if dropped > 0 {
+		logWarnf("Not serving %d keys to %s, it is limited to %d keys", dropped, hostname, hostConfig.MaxKeys)
 	}
 
-	return keys.String()
+	set.keys = keys.String()
+	return set
 }
 
 func (s *Server) getKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if s.warmingUp() {
+		http.Error(w, "Warming up", http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.keyringStale() {
+		http.Error(w, "Keyring is stale", http.StatusServiceUnavailable)
+		return
+	}
+	if m := s.maintenanceMode(); m != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(m.RetryAfter.Seconds())))
+		http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Rate limits and the time keys were last served are per host, even
+	// for hosts that share the default entry
+	hostname, entry, username, hostConfig, ok := s.authorizeHost(w, r, "/keys/")
+	if !ok {
+		return
+	}
+
+	if retryAfter, ok := s.allowRequest(hostname, hostConfig); !ok {
+		logDebugf("Rate limiting %s", hostname)
+		writeRateLimited(w, retryAfter)
+		return
+	}
+
+	// Let clients that poll often skip keys they already have
+	modified := s.keysModified(hostConfig)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	if since, ok := modifiedSince(r); ok && !modified.Truncate(time.Second).After(since) {
+		s.markServed(hostname)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// A host in lockdown gets an empty authorized_keys on purpose
+	if hostConfig.Lockdown {
+		logDebugf("Serving no keys for %s, host is in lockdown", hostname)
+		s.writeKeys(w, hostname, hostConfig, "")
+		return
+	}
+
+	// Hosts tend to poll at the same time, e.g. right after a reload, so
+	// identical requests in flight share one computation
+	group := r.URL.Query().Get("group")
+	// Usernames may contain "?" and "/", but neither they nor hostnames can
+	// contain control characters, so joining with NUL is unambiguous
+	requestKey := strings.Join([]string{hostname, username, group}, "\x00")
+	v, _, shared := s.keyRequests.Do(requestKey, func() (any, error) {
+		return s.resolveKeys(entry, username, group), nil
+	})
+	if shared {
+		logDebugf("Sharing keys of %s with a concurrent request", hostname)
+	}
+	result := v.(keysResult)
+	switch {
+	case result.forbidden != "":
+		http.Error(w, result.forbidden, http.StatusForbidden)
+		return
+	case result.noKeys != "":
+		s.noKeys(w, hostname, hostConfig, result.noKeys)
+		return
+	}
+
+	s.countKeySet(result.keySet)
+	logDebugf("Serving %d keys for %s and users %s", len(result.types), hostname, result.users)
+	s.writeKeys(w, hostname, hostConfig, result.keys)
+}
+
+// keysResult is what a key request resolves to: either keys, or why the
+// host is refused or gets none.
+type keysResult struct {
+	keySet
+	forbidden string // reason to answer 403
+	noKeys    string // reason there are no keys to serve
+}
+
+// resolveKeys looks up the keys a host gets, narrowed down to a user and the
+// members of a group if they aren't empty.
+func (s *Server) resolveKeys(hostname, username, group string) keysResult {
+	// Get list of authorized users for this host
+	users := s.getUsersForHost(hostname)
+
+	// Narrow down to the members of a group if requested
+	if group != "" {
+		members, ok := s.hostGroupMembers(hostname, group)
+		if !ok {
+			return keysResult{forbidden: "Group not assigned to host"}
+		}
+		users = slices.DeleteFunc(users, func(user string) bool { return !members[user] })
+	}
+
+	// Narrow down to a single user if requested
+	if username != "" {
+		if !s.isUserAuthorized(hostname, username) {
+			return keysResult{forbidden: "User not authorized for host"}
+		}
+		if !slices.Contains(users, username) {
+			return keysResult{noKeys: "User has no valid keys"}
+		}
+		users = []string{username}
+	}
+
+	if len(users) == 0 {
+		return keysResult{noKeys: "Host has no valid users"}
+	}
+
+	// Collect all public keys for authorized users
+	set := s.collectKeys(hostname, users)
+	if len(set.types) == 0 {
+		return keysResult{noKeys: "Host has no valid keys"}
+	}
+	return keysResult{keySet: set}
+}
+
+// keysModified returns when the keys a host gets last changed, either
+// through the config or through the keys of one of its users, including
+// keys that expired through max_key_age and certificates that became valid
+// or expired since.
+func (s *Server) keysModified(hostConfig HostConfig) time.Time {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	now := time.Now()
+	modified := s.configLoaded
+	later := func(t time.Time) {
+		if t.After(modified) && !t.After(now) {
+			modified = t
+		}
+	}
+	for user := range s.hostUsers(hostConfig) {
+		later(s.userKeys.ChangedAt(hostConfig.KeyringSubdir, user))
+		for _, key := range s.userKeysForHost(hostConfig, user) {
+			if s.config.MaxKeyAge > 0 {
+				later(key.ModTime.Add(s.config.MaxKeyAge))
+			}
+			if key.Certificate && hostConfig.AllowCertificates {
+				later(key.ValidAfter)
+				later(key.ValidBefore)
+			}
+		}
+	}
+	return modified
+}
+
+// modifiedSince returns the time from the If-Modified-Since header or the
+// since query parameter, which is a Unix timestamp or in RFC 3339 format.
+func modifiedSince(r *http.Request) (time.Time, bool) {
+	if value := r.URL.Query().Get("since"); value != "" {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(seconds, 0), true
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		return t, err == nil
+	}
+	if value := r.Header.Get("If-Modified-Since"); value != "" {
+		t, err := http.ParseTime(value)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// authorizeHost checks a GET request for a path of the form
+// <prefix><host>[/<user>] and the host's token. It returns the host as
+// requested, the name of the config entry used for it, which differs for
+// hosts served by the default entry, the optional user and the config of
+// the entry. If the request is not authorized it has already been answered
+// and ok is false.
+func (s *Server) authorizeHost(w http.ResponseWriter, r *http.Request, prefix string) (hostname, entry, username string, hostConfig HostConfig, ok bool) {
 	// Check HTTP method
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Extract hostname from path
-	path := strings.TrimPrefix(r.URL.Path, "/keys/")
-	if path == "" {
+	// Extract hostname and optional username from path, ignoring a trailing
+	// slash added by clients or proxies
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	hostname, username, _ = strings.Cut(path, "/")
+	if s.opts.HostFromSNI {
+		if r.TLS == nil || r.TLS.ServerName == "" {
+			http.Error(w, "Missing TLS server name", http.StatusBadRequest)
+			return
+		}
+		if hostname != "" && !strings.EqualFold(hostname, r.TLS.ServerName) {
+			http.Error(w, "Hostname doesn't match TLS server name", http.StatusBadRequest)
+			return
+		}
+		hostname = r.TLS.ServerName
+	}
+	if hostname == "" {
 		http.Error(w, "Missing hostname", http.StatusBadRequest)
 		return
 	}
-	hostname := path
+	if !validHostname(hostname) {
+		http.Error(w, "Invalid hostname", http.StatusBadRequest)
+		return
+	}
+	if username != "" && !validHostname(username) {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		return
+	}
+	if s.opts.LowercaseUsernames {
+		username = strings.ToLower(username)
+	}
 
 	// Validate Hostname
-	_, exists := s.config.Hosts[hostname]
+	entry, hostConfig, exists := s.resolveHost(hostname)
 	if !exists {
 		http.Error(w, "Host not found", http.StatusNotFound)
 		return
 	}
 
 	// Validate Authorization header
-	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Token ") {
-		http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
+	token, err := authToken(r)
+	if err != nil && s.opts.AllowQueryToken {
+		if queryToken, found := queryToken(r); found {
+			token, err = queryToken, nil
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	token := strings.TrimPrefix(authHeader, "Token ")
 
 	// Validate Authorization token
-	if !s.validateToken(hostname, token) {
+	if !s.validateTokens(entry, token) {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
-	// Get list of authorized users for this host
-	users := s.getUsersForHost(hostname)
-	if len(users) == 0 {
-		http.Error(w, "Host has no valid users", http.StatusNotFound)
-		return
+	return hostname, entry, username, hostConfig, true
+}
+
+// resolveHost looks up the config entry to use for a host, letting unknown
+// hosts fall back to the default entry. It returns the name of the entry.
+func (s *Server) resolveHost(hostname string) (string, HostConfig, bool) {
+	if hostConfig, exists := s.getHostConfig(hostname); exists {
+		return hostname, hostConfig, true
+	}
+	if hostConfig, exists := s.getHostConfig(defaultHost); exists {
+		logDebugf("Using %s entry for unknown host %s", defaultHost, hostname)
+		return defaultHost, hostConfig, true
 	}
+	return hostname, HostConfig{}, false
+}
 
-	// Collect all public keys for authorized users
-	keys := s.getKeysForUsers(users)
-	if len(strings.Split(keys, "\n")) <= 1 {
-		http.Error(w, "Host has no valid keys", http.StatusNotFound)
-		return
+// maxTokensPerRequest is how many comma-separated tokens a request may send.
+// Checking a hashed token is expensive, so a request can't have many of
+// them checked.
+const maxTokensPerRequest = 4
+
+// validateTokens is validateToken for a value that may hold several tokens
+// separated by commas, as sent by clients rotating tokens. Any valid token
+// is enough.
+func (s *Server) validateTokens(hostname, value string) bool {
+	tokens := splitTokens(value)
+	if len(tokens) > maxTokensPerRequest {
+		logDebugf("Rejecting %d tokens for %s, at most %d are checked", len(tokens), hostname, maxTokensPerRequest)
+		return false
 	}
+	return slices.ContainsFunc(tokens, func(t string) bool { return s.validateToken(hostname, t) })
+}
 
-	log.Printf("Serving %d keys for %s and users %s", len(strings.Split(keys, "\n")), hostname, users)
-	w.Header().Set("Content-Type", "text/plain")
+// warmingUp reports whether the server is still in its startup warmup.
+func (s *Server) warmingUp() bool {
+	return time.Since(s.startedAt) < s.opts.Warmup
+}
+
+// keyringStale reports whether the keyring is older than KeyringMaxAge.
+func (s *Server) keyringStale() bool {
+	return s.opts.KeyringMaxAge > 0 && time.Since(s.userKeys.LoadedAt()) > s.opts.KeyringMaxAge
+}
+
+// writeKeys sends keys to a host.
+func (s *Server) writeKeys(w http.ResponseWriter, hostname string, hostConfig HostConfig, keys string) {
+	s.setCacheControl(w, hostConfig)
+	s.setContentDisposition(w, hostConfig)
+	w.Header().Set("Content-Type", s.opts.ContentType)
 	fmt.Fprint(w, keys)
+	s.markServed(hostname)
+}
+
+// countServed records that keys of a user were served.
+func (s *Server) countServed(username string) {
+	s.timesServedLock.Lock()
+	s.timesServed[username]++
+	s.timesServedLock.Unlock()
+}
+
+// markServed records that a host successfully fetched its keys. Once
+// maxTrackedHosts hosts are recorded, the one served longest ago makes room
+// for a new one.
+func (s *Server) markServed(hostname string) {
+	s.lastServedLock.Lock()
+	defer s.lastServedLock.Unlock()
+
+	if _, ok := s.lastServed[hostname]; !ok && len(s.lastServed) >= maxTrackedHosts {
+		var oldest string
+		for name, t := range s.lastServed {
+			if oldest == "" || t.Before(s.lastServed[oldest]) {
+				oldest = name
+			}
+		}
+		delete(s.lastServed, oldest)
+	}
+	s.lastServed[hostname] = time.Now()
+}
+
+// defaultHost is the host entry used for hosts that aren't in the config.
+const defaultHost = "_default"
+
+// maxHostnameLength is the maximum length of a DNS name.
+const maxHostnameLength = 253
+
+// validHostname rejects hostnames that are too long or contain path
+// separators, traversal sequences or control characters.
+func validHostname(hostname string) bool {
+	if len(hostname) > maxHostnameLength || strings.Contains(hostname, "..") {
+		return false
+	}
+	for _, c := range hostname {
+		if c < 0x20 || c == 0x7f || c == '/' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) getHostConfig(hostname string) (HostConfig, bool) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	hostConfig, exists := s.config.Hosts[hostname]
+	return hostConfig, exists
+}
+
+// setCacheControl sets the Cache-Control header of a key response, preferring
+// the host's own setting over the global default.
+func (s *Server) setCacheControl(w http.ResponseWriter, hostConfig HostConfig) {
+	cacheControl := s.opts.CacheControl
+	if hostConfig.CacheControl != "" {
+		cacheControl = hostConfig.CacheControl
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+}
+
+// setContentDisposition names the file for clients that save a key
+// response, preferring the host's own filename over the global default.
+func (s *Server) setContentDisposition(w http.ResponseWriter, hostConfig HostConfig) {
+	filename := s.opts.Filename
+	if hostConfig.Filename != "" {
+		filename = hostConfig.Filename
+	}
+	if filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+}
+
+// splitTokens splits a comma-separated list of tokens, dropping empty ones.
+// A value without commas is returned as it is.
+func splitTokens(value string) []string {
+	if !strings.Contains(value, ",") {
+		return []string{value}
+	}
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// authError explains why a request's Authorization header can't be used.
+// Its text is meant for the client.
+type authError string
+
+func (e authError) Error() string { return string(e) }
+
+const (
+	errMissingAuthorization = authError("Missing Authorization header")
+	errUnsupportedScheme    = authError("Unsupported Authorization scheme, use Token or Bearer")
+	errEmptyToken           = authError("Empty token in Authorization header")
+)
+
+// authToken extracts the token from an Authorization header using either the
+// "Token" or the "Bearer" scheme. The error is one of the authError values.
+func authToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", errMissingAuthorization
+	}
+	scheme, token, _ := strings.Cut(authHeader, " ")
+	if !strings.EqualFold(scheme, "Token") && !strings.EqualFold(scheme, "Bearer") {
+		return "", errUnsupportedScheme
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return "", errEmptyToken
+	}
+	return token, nil
+}
+
+// queryToken extracts the token from the "token" query parameter, for clients
+// that can't set headers. The token is redacted from the request URL so that
+// it doesn't end up in logs.
+func queryToken(r *http.Request) (string, bool) {
+	query := r.URL.Query()
+	token := query.Get("token")
+	if token == "" {
+		return "", false
+	}
+	query.Set("token", "REDACTED")
+	r.URL.RawQuery = query.Encode()
+	return token, true
+}
+
+// noKeys answers a request for a host that ends up with no keys to serve.
+// By default this is a 404, but clients that would rather write an empty
+// authorized_keys file can get a 200 with an empty body instead.
+func (s *Server) noKeys(w http.ResponseWriter, hostname string, hostConfig HostConfig, msg string) {
+	if s.opts.AllowEmpty {
+		s.writeKeys(w, hostname, hostConfig, "")
+		return
+	}
+	http.Error(w, msg, http.StatusNotFound)
 }
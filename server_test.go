@@ -0,0 +1,112 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestCollectKeysNormalizesLines(t *testing.T) {
+	key1 := testKeyLine(t, "alice@laptop")
+	key2 := testKeyLine(t, "alice@desktop")
+
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"trailing newline", key1 + "\n", []string{key1}},
+		{"no trailing newline", key1, []string{key1}},
+		{"CRLF", key1 + "\r\n", []string{key1}},
+		{"blank lines", "\n\n" + key1 + "\n\n\n", []string{key1}},
+		{"two keys with trailing newline", key1 + "\n" + key2 + "\n", []string{key1, key2}},
+		{"two keys without trailing newline", key1 + "\n" + key2, []string{key1, key2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := fstest.MapFS{"keyring/alice/id_ed25519.pub": {Data: []byte(tt.data)}}
+			uk, err := NewUserKeys("keyring", KeyringOptions{Files: files})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys, skipped, err := uk.loadUserKeys("keyring/alice", "alice", make(map[string][]Key))
+			if err != nil || skipped != 0 {
+				t.Fatalf("loadUserKeys: %d skipped, error %v", skipped, err)
+			}
+			if len(keys) != len(tt.want) {
+				t.Fatalf("loadUserKeys returned %d keys, want %d", len(keys), len(tt.want))
+			}
+
+			s := &Server{
+				config:   Config{Hosts: map[string]HostConfig{"web1": {Users: []string{"alice"}}}},
+				userKeys: uk,
+			}
+			got := s.collectKeys("web1", []string{"alice"}).keys
+			want := ""
+			for _, line := range tt.want {
+				want += line + "\n"
+			}
+			if got != want {
+				t.Errorf("collectKeys returned %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMaxKeyAgeRejectedWithEmbeddedFiles(t *testing.T) {
+	s := &Server{opts: Options{Files: fstest.MapFS{}}}
+	if err := s.validateConfig(Config{MaxKeyAge: time.Hour}); err == nil {
+		t.Fatal("validateConfig accepted max_key_age with embedded files")
+	}
+	if err := s.validateConfig(Config{}); err != nil {
+		t.Fatalf("validateConfig without max_key_age: %v", err)
+	}
+}
+
+func TestMaxKeyAgeRejectedWithDatabase(t *testing.T) {
+	s := &Server{opts: Options{Keyring: KeyringOptions{Database: "keys.db"}}}
+	if err := s.validateConfig(Config{MaxKeyAge: time.Hour}); err == nil {
+		t.Fatal("validateConfig accepted max_key_age with a keyring database")
+	}
+}
+
+func TestTrackedHostsAreBounded(t *testing.T) {
+	s := &Server{
+		opts:       Options{RateLimit: 60},
+		limiters:   make(map[string]hostLimiter),
+		lastServed: make(map[string]time.Time),
+	}
+	for i := 0; i <= maxTrackedHosts; i++ {
+		hostname := fmt.Sprintf("host%d.example.com", i)
+		if _, ok := s.allowRequest(hostname, HostConfig{}); !ok {
+			t.Fatalf("allowRequest(%s) was rate limited", hostname)
+		}
+		s.markServed(hostname)
+	}
+	if len(s.limiters) > maxTrackedHosts {
+		t.Errorf("%d rate limiters kept, want at most %d", len(s.limiters), maxTrackedHosts)
+	}
+	if len(s.lastServed) > maxTrackedHosts {
+		t.Errorf("%d last served times kept, want at most %d", len(s.lastServed), maxTrackedHosts)
+	}
+}
@@ -0,0 +1,125 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certReloader serves the TLS certificate and reloads it from disk whenever
+// the certificate or key file changes, so that renewed certificates are
+// picked up without a restart.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	certLock sync.RWMutex
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	if err := cr.watch(); err != nil {
+		return nil, fmt.Errorf("failed to watch TLS certificate: %v", err)
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+
+	cr.certLock.Lock()
+	cr.cert = &cert
+	cr.certLock.Unlock()
+	return nil
+}
+
+// watch watches the directories of the certificate and key rather than the
+// files themselves, as tools like cert-manager replace them by swapping
+// symlinks.
+func (cr *certReloader) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		// Use a timer to debounce rapid file changes
+		var debounceTimer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !cr.affects(event.Name) {
+					continue
+				}
+				if debounceTimer != nil {
+					debounceTimer.Stop()
+				}
+				debounceTimer = time.AfterFunc(1000*time.Millisecond, func() {
+					if err := cr.load(); err != nil {
+						logErrorf("Error reloading TLS certificate: %v", err)
+					} else {
+						logInfof("TLS certificate reloaded successfully")
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logErrorf("TLS certificate watcher error: %v", err)
+			}
+		}
+	}()
+
+	for _, dir := range []string{filepath.Dir(cr.certPath), filepath.Dir(cr.keyPath)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// affects reports whether a change to path may have replaced the certificate
+// or key. Kubernetes updates mounted secrets by swapping the "..data" symlink.
+func (cr *certReloader) affects(path string) bool {
+	path = filepath.Clean(path)
+	return path == filepath.Clean(cr.certPath) || path == filepath.Clean(cr.keyPath) || filepath.Base(path) == "..data"
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.certLock.RLock()
+	defer cr.certLock.RUnlock()
+	return cr.cert, nil
+}
@@ -0,0 +1,161 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxCheckedTokens bounds each of the caches of checked tokens.
+const maxCheckedTokens = 1024
+
+// Hashing tokens is deliberately slow, and hosts present the same token on
+// every request, so checked tokens are remembered. Matches and mismatches
+// are kept apart, so that a flood of wrong tokens can't push out those of
+// real hosts.
+var (
+	matchedTokens     = make(map[[sha256.Size]byte]bool) // hash of hash and token
+	mismatchedTokens  = make(map[[sha256.Size]byte]bool)
+	checkedTokensLock sync.Mutex
+)
+
+// tokenHashed reports whether a token from the config is a bcrypt
+// ("$2a$", "$2b$" or "$2y$") or argon2 ("$argon2id$", "$argon2i$") hash
+// rather than the token itself.
+func tokenHashed(token string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$", "$argon2i$"} {
+		if strings.HasPrefix(token, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTokenHash checks that a hashed token from the config can be used.
+func validateTokenHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2") {
+		_, err := parseArgon2Hash(hash)
+		return err
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
+// hashMatches reports whether token is the one hash was made from.
+func hashMatches(hash, token string) bool {
+	id := sha256.Sum256([]byte(hash + "\x00" + token))
+	checkedTokensLock.Lock()
+	matched, mismatched := matchedTokens[id], mismatchedTokens[id]
+	checkedTokensLock.Unlock()
+	if matched || mismatched {
+		return matched
+	}
+
+	if strings.HasPrefix(hash, "$argon2") {
+		matched = argon2Matches(hash, token)
+	} else {
+		matched = bcrypt.CompareHashAndPassword([]byte(hash), []byte(token)) == nil
+	}
+
+	checkedTokensLock.Lock()
+	defer checkedTokensLock.Unlock()
+	cache := mismatchedTokens
+	if matched {
+		cache = matchedTokens
+	}
+	if len(cache) >= maxCheckedTokens {
+		clear(cache)
+	}
+	cache[id] = true
+	return matched
+}
+
+// argon2Hash is a parsed argon2 hash in the PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>".
+type argon2Hash struct {
+	id      bool
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	var h argon2Hash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return h, errors.New("malformed argon2 hash")
+	}
+	switch parts[1] {
+	case "argon2id":
+		h.id = true
+	case "argon2i":
+	default:
+		return h, fmt.Errorf("unsupported argon2 variant %s", parts[1])
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, fmt.Errorf("unsupported argon2 version %s", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, fmt.Errorf("malformed argon2 parameters %s", parts[3])
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, fmt.Errorf("malformed argon2 salt: %v", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return h, errors.New("malformed argon2 key")
+	}
+	return h, nil
+}
+
+func argon2Matches(hash, token string) bool {
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	var key []byte
+	if h.id {
+		key = argon2.IDKey([]byte(token), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(token), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// hashToken returns a bcrypt hash of token for the config. It backs the
+// -hash-token flag.
+func hashToken(token string) (string, error) {
+	if token == "" {
+		return "", errors.New("empty token")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
+	return string(hash), err
+}
@@ -19,9 +19,17 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
-	"log"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -31,16 +39,184 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// disabledMarker is the name of the file that disables a user.
+const disabledMarker = "disabled"
+
+// disabledKeyPrefix marks a key line that is validated but not served.
+const disabledKeyPrefix = "#disabled:"
+
+// Key is a validated public key from the keyring.
+type Key struct {
+	Line    string    // authorized_keys line, always newline terminated
+	Type    string    // key type, e.g. ssh-ed25519
+	ModTime time.Time // modification time of the key file
+
+	// Certificate is set for SSH certificates, which are only valid between
+	// ValidAfter and ValidBefore. A zero time means no bound.
+	Certificate bool
+	ValidAfter  time.Time
+	ValidBefore time.Time
+}
+
+// Valid reports whether the key can be used at time t. Plain keys are always
+// valid.
+func (k Key) Valid(t time.Time) bool {
+	if !k.Certificate {
+		return true
+	}
+	return (k.ValidAfter.IsZero() || !t.Before(k.ValidAfter)) && (k.ValidBefore.IsZero() || t.Before(k.ValidBefore))
+}
+
+// Comment returns the comment of the key, or an empty string if it has none.
+func (k Key) Comment() string {
+	_, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Line))
+	if err != nil {
+		return ""
+	}
+	return comment
+}
+
+// KeyValidator enforces custom policy on keys, e.g. by asking an external
+// policy service. It is called for every key before it is loaded.
+type KeyValidator interface {
+	// ValidateKey returns an error explaining why a key is rejected, or nil
+	// if it may be served.
+	ValidateKey(username string, key ssh.PublicKey, comment string) error
+}
+
+// KeyValidatorFunc adapts a function to the KeyValidator interface.
+type KeyValidatorFunc func(username string, key ssh.PublicKey, comment string) error
+
+func (f KeyValidatorFunc) ValidateKey(username string, key ssh.PublicKey, comment string) error {
+	return f(username, key, comment)
+}
+
+// NopKeyValidator accepts every key.
+type NopKeyValidator struct{}
+
+func (NopKeyValidator) ValidateKey(string, ssh.PublicKey, string) error { return nil }
+
+// KeyringOptions configures how the keyring is loaded.
+type KeyringOptions struct {
+	// OnReload is called after the keyring was reloaded successfully.
+	OnReload func()
+
+	// OnChange, if set, is called instead of reloading when the keyring
+	// changed, leaving it to the caller to reload with loadAllKeys.
+	OnChange func()
+
+	// Name labels the keyring in metrics. Defaults to "keyring".
+	Name string
+
+	// Validator is asked to approve every key. Defaults to NopKeyValidator.
+	Validator KeyValidator
+
+	// Subtrees, if set, returns subdirectories of the keyring that are
+	// loaded as keyrings of their own, in addition to the keyring itself.
+	Subtrees func() []string
+
+	// AllowUser, if set, decides which users may be loaded at all. Keys of
+	// other users are ignored.
+	AllowUser func(username string) bool
+
+	// WarnUnknownFiles, if set, decides whether files in user directories
+	// that aren't key files are warned about rather than silently skipped.
+	WarnUnknownFiles func() bool
+
+	// MaxLineLength is the longest line in bytes a key file may contain.
+	// Longer lines are rejected as malformed or malicious.
+	MaxLineLength int
+
+	// NormalizeUsername maps keyring directory names and keys file entries
+	// to usernames, e.g. to turn "jane.doe@corp.com" into "jane.doe". Keys
+	// of names that map to the same username are merged.
+	NormalizeUsername func(string) string
+
+	// CommentIdentity indexes keys by the first capture group (or whole
+	// match) of this expression in their comment, e.g. an email address,
+	// instead of by directory name. Keys whose comment doesn't match keep
+	// their directory name.
+	CommentIdentity *regexp.Regexp
+
+	// Ignore holds glob patterns of directory names in the keyring that
+	// aren't users, e.g. ".git". They are neither loaded nor do changes in
+	// them cause reloads.
+	Ignore []string
+
+	// KeysFile is a combined key file with "username:key" lines whose keys
+	// are added to those of the keyring directory.
+	KeysFile string
+
+	// QuietPeriod is how long the keyring must go without changes before
+	// it is reloaded, so that a sync in progress isn't loaded half done.
+	// Every change restarts the wait. Defaults to one second.
+	QuietPeriod time.Duration
+
+	// RescanInterval, if set, rescans the keyring this often even when
+	// nothing changed, so that the load time stays recent as long as
+	// loading works.
+	RescanInterval time.Duration
+
+	// CheckInterval, if set, is how often the files of the keyring are
+	// compared with their state at the last load, reloading if the watcher
+	// missed a change.
+	CheckInterval time.Duration
+
+	// Files, if set, is where the keyring and the keys file are read from
+	// instead of the file system, e.g. files embedded in the binary. The
+	// keyring isn't watched then.
+	Files fs.FS
+
+	// Database is an SQLite database to read keys from instead of the
+	// keyring directory. DatabaseQuery must return username and key
+	// columns. The database is checked for changes every DatabaseInterval,
+	// 30 seconds if it isn't positive.
+	Database         string
+	DatabaseQuery    string
+	DatabaseInterval time.Duration
+}
+
 type UserKeys struct {
-	keyring     map[string][]string // username -> array of public keys
+	keyring     map[string][]Key                // username -> array of public keys
+	subtrees    map[string]map[string][]Key     // subdirectory -> username -> public keys
+	changedAt   map[string]map[string]time.Time // subdirectory ("" for the keyring) -> username -> when their keys last changed
+	skipped     map[string]int                  // username -> number of unreadable or invalid key files
 	keyringPath string
-	keyringLock sync.RWMutex
+	keyringLock sync.RWMutex      // only held to read or swap the maps, never while scanning
+	scanLock    sync.Mutex        // serializes scans so that an older scan never replaces a newer one
+	fileKeys    map[string][]Key  // key file -> keys loaded from it by the last scan, guarded by scanLock
+	loadedState [sha256.Size]byte // keyringState at the last scan, guarded by scanLock
+	checked     bool              // whether the consistency check runs and needs loadedState
+	loadedAt    time.Time         // time of the last successful load
+	opts        KeyringOptions
 }
 
-func NewUserKeys(keyringPath string) (*UserKeys, error) {
+func NewUserKeys(keyringPath string, opts KeyringOptions) (*UserKeys, error) {
+	if opts.Validator == nil {
+		opts.Validator = NopKeyValidator{}
+	}
+	if opts.QuietPeriod <= 0 {
+		opts.QuietPeriod = time.Second
+	}
+	// time.Tick returns nil for intervals that aren't positive, which would
+	// stop polling the database for good
+	if opts.DatabaseInterval <= 0 {
+		opts.DatabaseInterval = 30 * time.Second
+	}
+	if opts.Name == "" {
+		opts.Name = "keyring"
+	}
+	watch := opts.Files == nil
+	if opts.Files == nil {
+		opts.Files = osFS{}
+	}
+
 	uk := &UserKeys{
-		keyring:     make(map[string][]string),
+		keyring:     make(map[string][]Key),
+		skipped:     make(map[string]int),
 		keyringPath: keyringPath,
+		opts:        opts,
+		checked:     watch && opts.Database == "" && opts.CheckInterval > 0,
 	}
 
 	// Load initial keys
@@ -48,9 +224,20 @@ func NewUserKeys(keyringPath string) (*UserKeys, error) {
 		return nil, err
 	}
 
-	// Start watching the keyring directory
-	if err := uk.watchKeyring(); err != nil {
-		return nil, err
+	// Start watching the keyring directory, or the database in its place.
+	// Embedded keyrings never change.
+	if opts.Database != "" {
+		go uk.pollDatabase()
+	} else if watch {
+		if err := uk.watchKeyring(); err != nil {
+			return nil, err
+		}
+		if uk.checked {
+			go uk.checkConsistency()
+		}
+	}
+	if opts.RescanInterval > 0 {
+		go uk.rescan()
 	}
 
 	return uk, nil
@@ -65,7 +252,7 @@ func (uk *UserKeys) watchKeyring() error {
 	go func() {
 		var (
 			debounceTimer    *time.Timer
-			debounceInterval = 1 * time.Second
+			debounceInterval = uk.opts.QuietPeriod
 			pendingReload    bool
 			mu               sync.Mutex
 		)
@@ -78,21 +265,24 @@ func (uk *UserKeys) watchKeyring() error {
 				return
 			}
 			pendingReload = false
-
-			if err := uk.loadAllKeys(); err != nil {
-				log.Printf("Error reloading keyring: %v", err)
-			} else {
-				log.Printf("Keyring reloaded successfully")
-			}
+			uk.changed()
 		}
 
+		heartbeat := time.NewTicker(watcherHeartbeatInterval)
+		defer heartbeat.Stop()
+		watchersUp.beat(uk.opts.Name)
 		for {
 			select {
+			case <-heartbeat.C:
+				watchersUp.beat(uk.opts.Name)
 			case event, ok := <-watcher.Events:
 				if !ok {
 					return
 				}
 
+				if uk.ignoredPath(event.Name) {
+					continue
+				}
 				if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || event.Has(fsnotify.Remove) {
 					mu.Lock()
 					pendingReload = true
@@ -107,85 +297,692 @@ func (uk *UserKeys) watchKeyring() error {
 				if !ok {
 					return
 				}
-				log.Printf("Keyring watcher error: %v", err)
+				logErrorf("Keyring watcher error: %v", err)
 			}
 		}
 	}()
 
+	if uk.opts.KeysFile != "" {
+		if err := watcher.Add(uk.opts.KeysFile); err != nil {
+			return err
+		}
+	}
+
 	return watcher.AddRecursive(uk.keyringPath)
 }
 
+// pollDatabase reloads the keyring whenever the database file changes.
+func (uk *UserKeys) pollDatabase() {
+	lastModified := uk.databaseModTime()
+	for range time.Tick(uk.opts.DatabaseInterval) {
+		modified := uk.databaseModTime()
+		if modified.Equal(lastModified) {
+			continue
+		}
+		lastModified = modified
+		uk.changed()
+	}
+}
+
+// rescan periodically reloads the keyring whether it changed or not.
+func (uk *UserKeys) rescan() {
+	for range time.Tick(uk.opts.RescanInterval) {
+		if err := uk.loadAllKeys(); err != nil {
+			logErrorf("Error rescanning keyring: %v", err)
+		}
+	}
+}
+
+// databaseModTime returns when the database or its write-ahead log was last
+// modified.
+func (uk *UserKeys) databaseModTime() time.Time {
+	var modified time.Time
+	for _, path := range []string{uk.opts.Database, uk.opts.Database + "-wal"} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified
+}
+
+// changed handles a change of the keyring.
+func (uk *UserKeys) changed() {
+	if uk.opts.OnChange != nil {
+		uk.opts.OnChange()
+		return
+	}
+	uk.reload()
+}
+
+// reload reloads the keyring after a change.
+func (uk *UserKeys) reload() {
+	if err := uk.loadAllKeys(); err != nil {
+		logErrorf("Error reloading keyring: %v", err)
+		return
+	}
+	logInfof("Keyring reloaded successfully")
+	if uk.opts.OnReload != nil {
+		uk.opts.OnReload()
+	}
+}
+
+// loadAllKeys rescans the keyring and swaps in the result. The scan can take
+// a while for large keyrings, so it runs without holding keyringLock; the
+// lock is only taken for the final swap and requests keep being served from
+// the previous keyring in the meantime.
 func (uk *UserKeys) loadAllKeys() error {
-	newKeyring := make(map[string][]string)
+	uk.scanLock.Lock()
+	defer uk.scanLock.Unlock()
+
+	start := time.Now()
+	defer func() { reloadDuration.observe(uk.opts.Name, time.Since(start).Seconds()) }()
+
+	// Taken before scanning, so that changes during the scan make the
+	// consistency check reload again. Walking the keyring is only worth it
+	// if the check runs.
+	var state [sha256.Size]byte
+	var stateErr error
+	if uk.checked {
+		state, stateErr = uk.keyringState()
+	}
+
+	fileKeys := make(map[string][]Key)
+	newKeyring, newSkipped, err := uk.scanKeyring(fileKeys)
+	if err != nil {
+		return err
+	}
+	newSubtrees, err := uk.scanSubtrees(fileKeys)
+	if err != nil {
+		return err
+	}
+	uk.fileKeys = fileKeys
+	if uk.checked && stateErr == nil {
+		uk.loadedState = state
+	}
+
+	uk.keyringLock.Lock()
+	uk.changedAt = map[string]map[string]time.Time{"": keysChanged(uk.keyring, newKeyring, uk.changedAt[""])}
+	for subdir, keyring := range newSubtrees {
+		uk.changedAt[subdir] = keysChanged(uk.subtrees[subdir], keyring, uk.changedAt[subdir])
+	}
+	uk.keyring = newKeyring
+	uk.subtrees = newSubtrees
+	uk.skipped = newSkipped
+	uk.loadedAt = time.Now()
+	uk.keyringLock.Unlock()
+
+	logInfof("Loaded keys for %d users", len(newKeyring))
+	return nil
+}
+
+// scanKeyring reads the keys of all users from disk. It must not touch the
+// current keyring. The keys of each key file are recorded in fileKeys.
+func (uk *UserKeys) scanKeyring(fileKeys map[string][]Key) (map[string][]Key, map[string]int, error) {
+	newKeyring := make(map[string][]Key)
+	newSkipped := make(map[string]int)
+
+	if uk.opts.Database != "" {
+		if err := uk.loadDatabase(newKeyring, newSkipped); err != nil {
+			return nil, nil, fmt.Errorf("error loading keys from database: %v", err)
+		}
+	} else if err := uk.scanDirectory(uk.keyringPath, newKeyring, newSkipped, fileKeys); err != nil {
+		return nil, nil, err
+	}
+
+	if uk.opts.KeysFile != "" {
+		if err := uk.loadKeysFile(newKeyring, newSkipped); err != nil {
+			return nil, nil, fmt.Errorf("error loading keys file: %v", err)
+		}
+	}
+
+	if uk.opts.CommentIdentity != nil {
+		newKeyring = uk.indexByComment(newKeyring)
+	}
+
+	uk.removeDisallowedUsers(newKeyring, newSkipped)
+	return newKeyring, newSkipped, nil
+}
+
+// scanSubtrees reads the keyrings of the subdirectories returned by the
+// Subtrees option. A subdirectory that doesn't exist yet is an empty
+// keyring, so that it doesn't keep the rest of the keyring from loading.
+func (uk *UserKeys) scanSubtrees(fileKeys map[string][]Key) (map[string]map[string][]Key, error) {
+	if uk.opts.Subtrees == nil {
+		return nil, nil
+	}
+
+	subtrees := make(map[string]map[string][]Key)
+	for _, subdir := range uk.opts.Subtrees() {
+		if _, ok := subtrees[subdir]; ok {
+			continue
+		}
+		keyring := make(map[string][]Key)
+		skipped := make(map[string]int)
+		err := uk.scanDirectory(filepath.Join(uk.keyringPath, subdir), keyring, skipped, fileKeys)
+		if errors.Is(err, fs.ErrNotExist) {
+			logWarnf("Keyring subdirectory %s does not exist, serving no keys from it", subdir)
+		} else if err != nil {
+			return nil, fmt.Errorf("error loading keyring subdirectory %s: %v", subdir, err)
+		}
+		uk.removeDisallowedUsers(keyring, skipped)
+		subtrees[subdir] = keyring
+	}
+	return subtrees, nil
+}
 
-	entries, err := os.ReadDir(uk.keyringPath)
+// removeDisallowedUsers drops the users the AllowUser option rejects.
+func (uk *UserKeys) removeDisallowedUsers(keyring map[string][]Key, skipped map[string]int) {
+	if uk.opts.AllowUser == nil {
+		return
+	}
+	for username := range keyring {
+		if !uk.opts.AllowUser(username) {
+			logWarnf("Ignoring keys of user %s, who is not allowed", username)
+			delete(keyring, username)
+			delete(skipped, username)
+		}
+	}
+}
+
+// indexByComment re-indexes keyring by the identity found in each key's
+// comment. An identity claimed by keys of several users is reported, and
+// the keys are merged.
+func (uk *UserKeys) indexByComment(keyring map[string][]Key) map[string][]Key {
+	indexed := make(map[string][]Key)
+	owners := make(map[string]string) // identity -> first user whose key claimed it
+
+	usernames := make([]string, 0, len(keyring))
+	for username := range keyring {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		for _, key := range keyring[username] {
+			identity := username
+			if _, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Line)); err == nil {
+				if match := uk.opts.CommentIdentity.FindStringSubmatch(comment); len(match) > 1 {
+					identity = uk.normalizeUsername(match[1])
+				} else if match != nil {
+					identity = uk.normalizeUsername(match[0])
+				}
+			}
+			if identity == "" {
+				identity = username
+			}
+
+			if owner, ok := owners[identity]; !ok {
+				owners[identity] = username
+			} else if owner != username {
+				logWarnf("Keys of users %s and %s both claim identity %s", owner, username, identity)
+			}
+			if !slices.ContainsFunc(indexed[identity], func(k Key) bool { return k.Line == key.Line }) {
+				indexed[identity] = append(indexed[identity], key)
+			}
+		}
+	}
+	return indexed
+}
+
+// scanDirectory adds the keys of every user directory in dir to keyring and
+// records them in fileKeys.
+func (uk *UserKeys) scanDirectory(dir string, keyring map[string][]Key, skipped map[string]int, fileKeys map[string][]Key) error {
+	entries, err := fs.ReadDir(uk.opts.Files, dir)
 	if err != nil {
 		return err
 	}
+	owners := make(map[string]string) // normalized username -> directory name
+	// Entries that don't look like users, to notice a keyring path that
+	// points at the wrong directory
+	var checked, suspicious int
+	subtrees := uk.subtreeRoots()
 
 	for _, entry := range entries {
+		// Subtrees are loaded as keyrings of their own, not as users
+		if uk.ignored(entry.Name()) || dir == uk.keyringPath && subtrees[entry.Name()] {
+			continue
+		}
+		checked++
 		if !entry.IsDir() {
+			suspicious++
 			continue
 		}
-		username := entry.Name()
-		keys, err := uk.loadUserKeys(username)
+		dirName := entry.Name()
+		userKeyDir := filepath.Join(dir, dirName)
+		keys, badFiles, err := uk.loadUserKeys(userKeyDir, dirName, fileKeys)
 		if err != nil {
-			log.Printf("Error loading keys for user %s: %v", username, err)
-			continue
+			logWarnf("Error loading keys for user %s: %v", dirName, err)
+		}
+
+		username := uk.normalizeUsername(dirName)
+		if username != dirName {
+			if owner, ok := owners[username]; ok {
+				logWarnf("Keyring directories %s and %s are both user %s, merging their keys", owner, dirName, username)
+			}
+			owners[username] = dirName
+		}
+		if badFiles > 0 {
+			skipped[username] += badFiles
 		}
 		if len(keys) > 0 {
-			newKeyring[username] = keys
+			keyring[username] = append(keyring[username], keys...)
+		} else {
+			suspicious++
 		}
 	}
 
-	uk.keyringLock.Lock()
-	uk.keyring = newKeyring
-	uk.keyringLock.Unlock()
-
-	log.Printf("Loaded keys for %d users", len(newKeyring))
+	if suspicious*2 > checked {
+		logWarnf("%d of %d entries in keyring %s are files or directories without valid keys, is it the right directory?", suspicious, checked, dir)
+	}
 	return nil
 }
 
-func (uk *UserKeys) loadUserKeys(username string) ([]string, error) {
-	var keys []string
-	userKeyDir := filepath.Join(uk.keyringPath, username)
+// subtreeRoots returns the top-level directories of the keyring that hold
+// subtrees rather than users.
+func (uk *UserKeys) subtreeRoots() map[string]bool {
+	roots := make(map[string]bool)
+	if uk.opts.Subtrees == nil {
+		return roots
+	}
+	for _, subdir := range uk.opts.Subtrees() {
+		roots[strings.SplitN(filepath.ToSlash(subdir), "/", 2)[0]] = true
+	}
+	return roots
+}
+
+// ignored reports whether a directory name in the keyring matches one of
+// the Ignore patterns.
+func (uk *UserKeys) ignored(name string) bool {
+	for _, pattern := range uk.opts.Ignore {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredPath reports whether a path in the keyring is an ignored directory
+// at the top of the keyring, or inside an ignored directory.
+func (uk *UserKeys) ignoredPath(name string) bool {
+	rel, err := filepath.Rel(uk.keyringPath, name)
+	if err != nil || !filepath.IsLocal(rel) {
+		return false
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) > 1 {
+		// The last part may be a key file, whose name doesn't matter
+		parts = parts[:len(parts)-1]
+	}
+	return slices.ContainsFunc(parts, uk.ignored)
+}
+
+// normalizeUsername applies the NormalizeUsername option to a name from the
+// keyring.
+func (uk *UserKeys) normalizeUsername(name string) string {
+	if uk.opts.NormalizeUsername == nil {
+		return name
+	}
+	return uk.opts.NormalizeUsername(name)
+}
+
+// loadUserKeys reads all valid public keys of a user and records them per key
+// file in fileKeys. It also returns the number of key files that were skipped
+// because they couldn't be read or parsed. A key file that can't be read
+// keeps the keys the previous scan loaded from it, so that a flaky filesystem
+// doesn't make keys vanish while keys removed from other files still go; they
+// are returned along with the error.
+func (uk *UserKeys) loadUserKeys(userKeyDir, username string, fileKeys map[string][]Key) ([]Key, int, error) {
+	var keys []Key
+	var skipped int
+	var readErr error
+	seen := make(map[string]string) // fingerprint -> key file
+
+	// A disabled marker file keeps the user's keys from being served
+	// without having to remove them
+	if _, err := fs.Stat(uk.opts.Files, filepath.Join(userKeyDir, disabledMarker)); err == nil {
+		logInfof("User %s is disabled", username)
+		return nil, 0, nil
+	}
 
-	files, err := os.ReadDir(userKeyDir)
+	// ReadDir sorts by file name, which makes the order of the keys
+	// deterministic and lets users order them with prefixes like "01-"
+	files, err := fs.ReadDir(uk.opts.Files, userKeyDir)
 	if err != nil {
-		return nil, err
+		// None of the files can be read, so all of them keep their keys
+		var keyPaths []string
+		for keyPath := range uk.fileKeys {
+			if filepath.Dir(keyPath) == userKeyDir {
+				keyPaths = append(keyPaths, keyPath)
+			}
+		}
+		sort.Strings(keyPaths)
+		for _, keyPath := range keyPaths {
+			fileKeys[keyPath] = uk.fileKeys[keyPath]
+			keys = append(keys, uk.fileKeys[keyPath]...)
+		}
+		if len(keys) > 0 {
+			logWarnf("Keeping the %d keys loaded before for user %s", len(keys), username)
+		}
+		return keys, 0, err
 	}
 
+	warnUnknown := uk.opts.WarnUnknownFiles != nil && uk.opts.WarnUnknownFiles()
 	for _, file := range files {
 		if !strings.HasSuffix(file.Name(), ".pub") {
+			if warnUnknown && !file.IsDir() && !uk.ignored(file.Name()) {
+				logWarnf("Ignoring file %s of user %s, key files must end in .pub", filepath.Join(userKeyDir, file.Name()), username)
+			}
 			continue
 		}
 
 		keyPath := filepath.Join(userKeyDir, file.Name())
-		keyData, err := os.ReadFile(keyPath)
+		keyData, err := fs.ReadFile(uk.opts.Files, keyPath)
+		var info fs.FileInfo
+		if err == nil {
+			info, err = file.Info()
+		}
 		if err != nil {
-			log.Printf("Error reading key file %s: %v", keyPath, err)
+			readErr = fmt.Errorf("error reading key file %s: %v", keyPath, err)
+			skipped++
+			if previous, ok := uk.fileKeys[keyPath]; ok {
+				logWarnf("Keeping the %d keys loaded before from %s", len(previous), keyPath)
+				fileKeys[keyPath] = previous
+				keys = append(keys, previous...)
+			}
+			continue
+		}
+		if uk.exceedsMaxLineLength(string(keyData)) {
+			logWarnf("Skipping key file %s with lines longer than %d bytes", keyPath, uk.opts.MaxLineLength)
+			skipped++
 			continue
 		}
 
-		// Validate the key
-		_, _, _, _, err = ssh.ParseAuthorizedKey(keyData)
-		if err != nil {
-			log.Printf("Invalid key found in %s", keyPath)
+		// Validate each key in the file separately, so that a key can be
+		// disabled without touching the other keys
+		invalid := false
+		var loaded []Key
+		for _, line := range strings.Split(string(keyData), "\n") {
+			key, ok, bad := uk.parseKeyLine(username, line, keyPath, info.ModTime(), seen)
+			invalid = invalid || bad
+			if ok {
+				loaded = append(loaded, key)
+			}
+		}
+		fileKeys[keyPath] = loaded
+		keys = append(keys, loaded...)
+		if invalid {
+			skipped++
+		}
+	}
+
+	return keys, skipped, readErr
+}
+
+// exceedsMaxLineLength reports whether any line of data is longer than the
+// configured maximum.
+func (uk *UserKeys) exceedsMaxLineLength(data string) bool {
+	if uk.opts.MaxLineLength <= 0 {
+		return false
+	}
+	for _, line := range strings.Split(data, "\n") {
+		if len(line) > uk.opts.MaxLineLength {
+			return true
+		}
+	}
+	return false
+}
+
+// parseKeyLine validates a single line of a key file. Comments, disabled,
+// duplicate, rejected and invalid keys are not returned, and rejected or
+// invalid keys are also reported through invalid. seen maps the fingerprints
+// of the user's keys loaded so far to the file they came from.
+func (uk *UserKeys) parseKeyLine(username, line, keyPath string, modTime time.Time, seen map[string]string) (key Key, ok, invalid bool) {
+	line = strings.TrimSpace(line)
+	disabled := strings.HasPrefix(line, disabledKeyPrefix)
+	if disabled {
+		line = strings.TrimSpace(strings.TrimPrefix(line, disabledKeyPrefix))
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return Key{}, false, false
+	}
+
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		logWarnf("Invalid key found in %s", keyPath)
+		return Key{}, false, true
+	}
+	if disabled {
+		logInfof("Skipping disabled key in %s", keyPath)
+		return Key{}, false, false
+	}
+	if err := uk.checkKey(username, pub, comment); errors.Is(err, errCertificateExpired) {
+		logWarnf("Skipping expired certificate %s in %s", ssh.FingerprintSHA256(pub), keyPath)
+		return Key{}, false, false
+	} else if err != nil {
+		logWarnf("Rejected key in %s: %v", keyPath, err)
+		return Key{}, false, true
+	}
+
+	fingerprint := ssh.FingerprintSHA256(pub)
+	if firstPath, exists := seen[fingerprint]; exists {
+		logWarnf("Duplicate key %s in %s, already loaded from %s", fingerprint, keyPath, firstPath)
+		return Key{}, false, false
+	}
+	seen[fingerprint] = keyPath
+
+	key = Key{Line: line + "\n", Type: pub.Type(), ModTime: modTime}
+	if cert, isCert := pub.(*ssh.Certificate); isCert {
+		key.Certificate = true
+		key.ValidAfter = certTime(cert.ValidAfter)
+		if cert.ValidBefore != ssh.CertTimeInfinity {
+			key.ValidBefore = certTime(cert.ValidBefore)
+		}
+	}
+
+	return key, true, false
+}
+
+// errCertificateExpired is returned by checkKey for certificates past their
+// validity period.
+var errCertificateExpired = errors.New("certificate has expired")
+
+// checkKey applies the checks a parsed key has to pass on top of being
+// well-formed: the Validator option and, for certificates, expiry. It is
+// shared by the keyring and /validate, so that both accept the same keys.
+func (uk *UserKeys) checkKey(username string, pub ssh.PublicKey, comment string) error {
+	// Replicas take their keys from upstream and have no validator
+	if uk.opts.Validator != nil {
+		if err := uk.opts.Validator.ValidateKey(username, pub, comment); err != nil {
+			return err
+		}
+	}
+	if cert, ok := pub.(*ssh.Certificate); ok && cert.ValidBefore != ssh.CertTimeInfinity {
+		if validBefore := certTime(cert.ValidBefore); !validBefore.IsZero() && !time.Now().Before(validBefore) {
+			return errCertificateExpired
+		}
+	}
+	return nil
+}
+
+// certTime converts a certificate timestamp, returning the zero time for 0.
+func certTime(seconds uint64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	if seconds > math.MaxInt64 {
+		seconds = math.MaxInt64
+	}
+	return time.Unix(int64(seconds), 0)
+}
+
+// loadKeysFile adds the keys from a combined key file, as exported by legacy
+// systems, to keyring. Each line holds a username and a key separated by a
+// colon.
+func (uk *UserKeys) loadKeysFile(keyring map[string][]Key, skipped map[string]int) error {
+	path := uk.opts.KeysFile
+	data, err := fs.ReadFile(uk.opts.Files, path)
+	if err != nil {
+		return err
+	}
+	info, err := fs.Stat(uk.opts.Files, path)
+	if err != nil {
+		return err
+	}
+
+	// Keys that are also in the user's directory are only served once
+	seen := make(map[string]map[string]string) // username -> fingerprint -> key file
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if uk.exceedsMaxLineLength(line) {
+			logWarnf("Skipping line %d of %s, it is longer than %d bytes", i+1, path, uk.opts.MaxLineLength)
+			continue
+		}
+
+		username, keyLine, found := strings.Cut(line, ":")
+		username = uk.normalizeUsername(strings.TrimSpace(username))
+		if !found || username == "" {
+			logWarnf("Invalid entry on line %d of %s", i+1, path)
 			continue
 		}
 
-		keyStr := string(keyData)
-		if !strings.HasSuffix(keyStr, "\n") {
-			keyStr += "\n"
+		if seen[username] == nil {
+			seen[username] = make(map[string]string)
+			for _, key := range keyring[username] {
+				if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Line)); err == nil {
+					seen[username][ssh.FingerprintSHA256(pub)] = filepath.Join(uk.keyringPath, username)
+				}
+			}
+		}
+
+		key, ok, invalid := uk.parseKeyLine(username, keyLine, path, info.ModTime(), seen[username])
+		if invalid {
+			skipped[username]++
+		}
+		if ok {
+			keyring[username] = append(keyring[username], key)
 		}
-		keys = append(keys, keyStr)
 	}
 
-	return keys, nil
+	return nil
 }
 
-func (uk *UserKeys) GetUserKeys(username string) []string {
+func (uk *UserKeys) GetUserKeys(username string) []Key {
 	uk.keyringLock.RLock()
 	defer uk.keyringLock.RUnlock()
 	return uk.keyring[username]
 }
+
+// GetSubtreeUserKeys returns the keys of a user in a keyring subdirectory
+// loaded through the Subtrees option.
+func (uk *UserKeys) GetSubtreeUserKeys(subdir, username string) []Key {
+	uk.keyringLock.RLock()
+	defer uk.keyringLock.RUnlock()
+	return uk.subtrees[subdir][username]
+}
+
+// ChangedAt returns when the keys of a user in the keyring, or in a keyring
+// subdirectory if subdir isn't empty, last changed. Users whose keys were
+// removed keep the time of the removal. Keys loaded at startup count as
+// changed then.
+func (uk *UserKeys) ChangedAt(subdir, username string) time.Time {
+	uk.keyringLock.RLock()
+	defer uk.keyringLock.RUnlock()
+	return uk.changedAt[subdir][username]
+}
+
+// keysChanged updates changedAt, the change times of the users of keyring
+// before, for the users of keyring after.
+func keysChanged(before, after map[string][]Key, changedAt map[string]time.Time) map[string]time.Time {
+	now := time.Now()
+	updated := make(map[string]time.Time, len(after))
+	for username, t := range changedAt {
+		updated[username] = t
+	}
+	sameKeys := func(a, b Key) bool { return a.Line == b.Line }
+	for username, keys := range after {
+		if !slices.EqualFunc(before[username], keys, sameKeys) {
+			updated[username] = now
+		}
+	}
+	for username := range before {
+		if _, ok := after[username]; !ok {
+			updated[username] = now
+		}
+	}
+	return updated
+}
+
+// setKeyring replaces the whole keyring, e.g. with keys pulled from an
+// upstream keyserver.
+func (uk *UserKeys) setKeyring(keyring map[string][]Key, subtrees map[string]map[string][]Key) {
+	uk.keyringLock.Lock()
+	uk.changedAt = map[string]map[string]time.Time{"": keysChanged(uk.keyring, keyring, uk.changedAt[""])}
+	for subdir, subtree := range subtrees {
+		uk.changedAt[subdir] = keysChanged(uk.subtrees[subdir], subtree, uk.changedAt[subdir])
+	}
+	uk.keyring = keyring
+	uk.subtrees = subtrees
+	uk.loadedAt = time.Now()
+	uk.keyringLock.Unlock()
+
+	logDebugf("Loaded keys for %d users", len(keyring))
+}
+
+// SkippedFiles returns the number of key files skipped during the last
+// reload, per user and in total.
+func (uk *UserKeys) SkippedFiles() (map[string]int, int) {
+	uk.keyringLock.RLock()
+	defer uk.keyringLock.RUnlock()
+
+	perUser := make(map[string]int, len(uk.skipped))
+	total := 0
+	for user, count := range uk.skipped {
+		perUser[user] = count
+		total += count
+	}
+	return perUser, total
+}
+
+// AllKeys returns a snapshot of the keys of all users.
+func (uk *UserKeys) AllKeys() map[string][]Key {
+	uk.keyringLock.RLock()
+	defer uk.keyringLock.RUnlock()
+
+	keyring := make(map[string][]Key, len(uk.keyring))
+	for user, keys := range uk.keyring {
+		keyring[user] = keys
+	}
+	return keyring
+}
+
+// AllSubtrees returns a snapshot of the keys of all users of the keyring
+// subdirectories, by subdirectory.
+func (uk *UserKeys) AllSubtrees() map[string]map[string][]Key {
+	uk.keyringLock.RLock()
+	defer uk.keyringLock.RUnlock()
+
+	subtrees := make(map[string]map[string][]Key, len(uk.subtrees))
+	for subdir, keyring := range uk.subtrees {
+		subtrees[subdir] = keyring
+	}
+	return subtrees
+}
+
+// LoadedAt returns when the keyring was last loaded successfully, or the zero
+// time if it never was.
+func (uk *UserKeys) LoadedAt() time.Time {
+	uk.keyringLock.RLock()
+	defer uk.keyringLock.RUnlock()
+	return uk.loadedAt
+}
+
+// UserCount returns the number of users with at least one valid key.
+func (uk *UserKeys) UserCount() int {
+	uk.keyringLock.RLock()
+	defer uk.keyringLock.RUnlock()
+	return len(uk.keyring)
+}
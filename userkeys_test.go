@@ -0,0 +1,207 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testKeyLine returns an authorized_keys line of a new ed25519 key.
+func testKeyLine(t *testing.T, comment string) string {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment
+}
+
+func TestGetUserKeysDuringSlowLoad(t *testing.T) {
+	files := fstest.MapFS{
+		"keyring/alice/id_ed25519.pub": {Data: []byte(testKeyLine(t, "alice@laptop") + "\n")},
+	}
+
+	// The validator blocks once slow is set, holding up the load
+	var slow atomic.Bool
+	validating := make(chan struct{}, 1)
+	release := make(chan struct{})
+	validator := KeyValidatorFunc(func(string, ssh.PublicKey, string) error {
+		if slow.Load() {
+			validating <- struct{}{}
+			<-release
+		}
+		return nil
+	})
+
+	uk, err := NewUserKeys("keyring", KeyringOptions{Files: files, Validator: validator})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow.Store(true)
+	loaded := make(chan error)
+	go func() { loaded <- uk.loadAllKeys() }()
+	<-validating
+
+	got := make(chan []Key)
+	go func() { got <- uk.GetUserKeys("alice") }()
+	select {
+	case keys := <-got:
+		if len(keys) != 1 {
+			t.Errorf("GetUserKeys(alice) during load returned %d keys, want 1", len(keys))
+		}
+	case <-time.After(time.Second):
+		t.Error("GetUserKeys blocked while the keyring was loading")
+	}
+
+	close(release)
+	if err := <-loaded; err != nil {
+		t.Fatalf("loadAllKeys: %v", err)
+	}
+}
+
+func TestMissingSubtree(t *testing.T) {
+	files := fstest.MapFS{
+		"keyring/alice/id_ed25519.pub":            {Data: []byte(testKeyLine(t, "alice@laptop") + "\n")},
+		"keyring/tenants/acme/bob/id_ed25519.pub": {Data: []byte(testKeyLine(t, "bob@laptop") + "\n")},
+	}
+	subtrees := func() []string { return []string{"tenants/acme", "tenants/missing"} }
+
+	uk, err := NewUserKeys("keyring", KeyringOptions{Files: files, Subtrees: subtrees})
+	if err != nil {
+		t.Fatalf("NewUserKeys with a missing subtree: %v", err)
+	}
+	if keys := uk.GetUserKeys("alice"); len(keys) != 1 {
+		t.Errorf("GetUserKeys(alice) = %d keys, want 1", len(keys))
+	}
+	if keys := uk.GetSubtreeUserKeys("tenants/acme", "bob"); len(keys) != 1 {
+		t.Errorf("GetSubtreeUserKeys(tenants/acme, bob) = %d keys, want 1", len(keys))
+	}
+	if keys := uk.GetSubtreeUserKeys("tenants/missing", "bob"); len(keys) != 0 {
+		t.Errorf("GetSubtreeUserKeys(tenants/missing, bob) = %d keys, want 0", len(keys))
+	}
+}
+
+func TestSubtreeRootsAreNotUsers(t *testing.T) {
+	files := fstest.MapFS{
+		"keyring/alice/id_ed25519.pub":    {Data: []byte(testKeyLine(t, "alice@laptop") + "\n")},
+		"keyring/acme/id_ed25519.pub":     {Data: []byte(testKeyLine(t, "stray@laptop") + "\n")},
+		"keyring/acme/bob/id_ed25519.pub": {Data: []byte(testKeyLine(t, "bob@laptop") + "\n")},
+	}
+	subtrees := func() []string { return []string{"acme"} }
+
+	uk, err := NewUserKeys("keyring", KeyringOptions{Files: files, Subtrees: subtrees})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := uk.GetUserKeys("acme"); len(keys) != 0 {
+		t.Errorf("GetUserKeys(acme) = %d keys, want 0 for a subtree", len(keys))
+	}
+	if keys := uk.GetSubtreeUserKeys("acme", "bob"); len(keys) != 1 {
+		t.Errorf("GetSubtreeUserKeys(acme, bob) = %d keys, want 1", len(keys))
+	}
+}
+
+func TestValidateKeyMatchesKeyring(t *testing.T) {
+	line := testKeyLine(t, "alice@laptop")
+	validator := KeyValidatorFunc(func(username string, _ ssh.PublicKey, _ string) error {
+		if username == "mallory" {
+			return errors.New("user is blocked")
+		}
+		return nil
+	})
+	files := fstest.MapFS{
+		"keyring/alice/id_ed25519.pub":   {Data: []byte(line + "\n")},
+		"keyring/mallory/id_ed25519.pub": {Data: []byte(line + "\n")},
+	}
+	uk, err := NewUserKeys("keyring", KeyringOptions{Files: files, Validator: validator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{userKeys: uk}
+
+	for _, username := range []string{"alice", "mallory"} {
+		loaded := len(uk.GetUserKeys(username)) > 0
+		if valid := s.validateKey(username, line).Valid; valid != loaded {
+			t.Errorf("validateKey for %s = %v, but the keyring loaded it: %v", username, valid, loaded)
+		}
+	}
+}
+
+// flakyFS is a MapFS whose files in fail can't be read.
+type flakyFS struct {
+	fstest.MapFS
+	fail map[string]bool
+}
+
+func (f flakyFS) Open(name string) (fs.File, error) {
+	if f.fail[name] {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return f.MapFS.Open(name)
+}
+
+func (f flakyFS) ReadFile(name string) ([]byte, error) {
+	if f.fail[name] {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrPermission}
+	}
+	return f.MapFS.ReadFile(name)
+}
+
+func TestUnreadableKeyFileKeepsOnlyItsKeys(t *testing.T) {
+	laptop := testKeyLine(t, "alice@laptop")
+	desktop := testKeyLine(t, "alice@desktop")
+	files := flakyFS{
+		MapFS: fstest.MapFS{
+			"keyring/alice/laptop.pub":  {Data: []byte(laptop + "\n")},
+			"keyring/alice/desktop.pub": {Data: []byte(desktop + "\n")},
+		},
+		fail: make(map[string]bool),
+	}
+	uk, err := NewUserKeys("keyring", KeyringOptions{Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The desktop key is revoked while the laptop key can't be read
+	files.MapFS["keyring/alice/desktop.pub"] = &fstest.MapFile{Data: []byte("")}
+	files.fail["keyring/alice/laptop.pub"] = true
+	if err := uk.loadAllKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := uk.GetUserKeys("alice")
+	if len(keys) != 1 || keys[0].Line != laptop+"\n" {
+		t.Fatalf("GetUserKeys(alice) = %v, want only the laptop key", keys)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// usernameNormalizer builds the function that maps keyring directory names
+// to the usernames used in the config. pattern is an optional regular
+// expression whose first capture group (or whole match) becomes the
+// username; names it doesn't match are kept as they are. rules are applied
+// afterwards, in order:
+//
+//   - strip-domain: drop everything from the first "@"
+//   - lowercase: convert to lower case
+//
+// It returns nil when there is nothing to do.
+func usernameNormalizer(pattern string, rules []string) (func(string) string, error) {
+	var steps []func(string) string
+
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid username pattern: %v", err)
+		}
+		steps = append(steps, func(name string) string {
+			match := re.FindStringSubmatch(name)
+			switch {
+			case match == nil:
+				return name
+			case len(match) > 1:
+				return match[1]
+			default:
+				return match[0]
+			}
+		})
+	}
+
+	for _, rule := range rules {
+		switch rule {
+		case "strip-domain":
+			steps = append(steps, func(name string) string {
+				name, _, _ = strings.Cut(name, "@")
+				return name
+			})
+		case "lowercase":
+			steps = append(steps, strings.ToLower)
+		default:
+			return nil, fmt.Errorf("unknown username rule %q", rule)
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, nil
+	}
+	return func(name string) string {
+		for _, step := range steps {
+			name = step(name)
+		}
+		return name
+	}, nil
+}
@@ -84,10 +84,16 @@ func (m *RWatcher) start() {
 		select {
 
 		case e := <-m.fsnotify.Events:
+			// Directories created (or moved in) after the initial walk need
+			// their own watches, or changes inside them go unnoticed. Files
+			// created before the watch is added are only seen through the
+			// directory's own Create event.
 			s, err := os.Stat(e.Name)
 			if err == nil && s != nil && s.IsDir() {
 				if e.Op&fsnotify.Create != 0 {
-					m.watchRecursive(e.Name, false)
+					if err := m.watchRecursive(e.Name, false); err != nil {
+						m.Errors <- err
+					}
 				}
 			}
 			//Can't stat a deleted directory, so just pretend that it's always a directory and
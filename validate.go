@@ -0,0 +1,89 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxValidateBody limits the size of a key submitted to /validate.
+const maxValidateBody = 64 << 10
+
+type validateResponse struct {
+	Valid       bool   `json:"valid"`
+	Error       string `json:"error,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+	Certificate bool   `json:"certificate,omitempty"`
+}
+
+// validateHandler checks a public key submitted in the request body the same
+// way keys are checked when the keyring is loaded, without touching the
+// keyring. The optional user parameter is the user the key is checked for.
+func (s *Server) validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValidateBody))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	username := r.URL.Query().Get("user")
+	if username != "" && s.opts.Keyring.NormalizeUsername != nil {
+		username = s.opts.Keyring.NormalizeUsername(username)
+	}
+	writeJSON(w, s.validateKey(username, strings.TrimSpace(string(data))))
+}
+
+func (s *Server) validateKey(username, line string) validateResponse {
+	if line == "" {
+		return validateResponse{Error: "no key submitted"}
+	}
+	if strings.Contains(line, "\n") {
+		return validateResponse{Error: "more than one line submitted"}
+	}
+	if maxLen := s.opts.Keyring.MaxLineLength; maxLen > 0 && len(line) > maxLen {
+		return validateResponse{Error: "key is too long"}
+	}
+
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return validateResponse{Error: err.Error()}
+	}
+	if err := s.userKeys.checkKey(username, pub, comment); err != nil {
+		return validateResponse{Error: err.Error()}
+	}
+	_, isCert := pub.(*ssh.Certificate)
+	return validateResponse{
+		Valid:       true,
+		Type:        pub.Type(),
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		Comment:     comment,
+		Certificate: isCert,
+	}
+}
@@ -0,0 +1,76 @@
+/*
+SSH Key Server - A lightweight HTTP server that manages SSH public keys
+Copyright (C) 2024 elsitar
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds a single webhook notification.
+const webhookTimeout = 10 * time.Second
+
+type reloadNotification struct {
+	Trigger   string    `json:"trigger"`
+	Timestamp time.Time `json:"timestamp"`
+	Hosts     int       `json:"hosts"`
+	Groups    int       `json:"groups"`
+	Users     int       `json:"users"`
+}
+
+// notifyReload tells the webhook, if any, that trigger was reloaded. The
+// notification is sent in the background so that a slow or failing webhook
+// never holds up a reload.
+func (s *Server) notifyReload(trigger string) {
+	if s.opts.WebhookURL == "" {
+		return
+	}
+
+	s.configLock.RLock()
+	notification := reloadNotification{
+		Trigger:   trigger,
+		Timestamp: time.Now().UTC(),
+		Hosts:     len(s.config.Hosts),
+		Groups:    len(s.config.Groups),
+	}
+	s.configLock.RUnlock()
+	notification.Users = s.userKeys.UserCount()
+
+	go func() {
+		body, err := json.Marshal(notification)
+		if err != nil {
+			logWarnf("Error encoding webhook notification: %v", err)
+			return
+		}
+
+		client := &http.Client{Timeout: webhookTimeout}
+		resp, err := client.Post(s.opts.WebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logWarnf("Error notifying webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			logWarnf("Webhook responded with %s", resp.Status)
+		}
+	}()
+}